@@ -6,25 +6,63 @@ import (
 	"bftkvstore/logger"
 	"bftkvstore/protocol"
 	"bftkvstore/utils"
+	"cmp"
+	stdcontext "context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var serverHostname string
+// time given to in-flight requests and peers to finish once a shutdown starts
+const _SHUTDOWN_TIMEOUT = 10 * time.Second
+
 var serverPortPtr *string
 var configPathPtr *string
+var peersPtr *string
+var fanoutPtr *int
+var tlsPtr *string
+var peerPortPtr *string
+var clientPortPtr *string
+var peerBindPtr *string
+var clientBindPtr *string
+var clientTLSPtr *string
+var adminSocketPtr *string
+var listenPtr *string
+var advertisePtr *string
+var allowUnauthenticatedPtr *bool
 
 func init() {
-	serverHostname = utils.GetOutboundIP().String()
 	serverPortPtr = flag.String("port", "8089", "specifies which port must be used by the application")
+	peerPortPtr = flag.String("peer-port", "", "specifies the port for other nodes, defaults to --port")
+	clientPortPtr = flag.String("client-port", "", "specifies the port for the user api, defaults to --port")
+	listenPtr = flag.String("listen", "", "specifies the address the ports are bound to, every interface by default")
+	peerBindPtr = flag.String("peer-bind", "", "specifies the address the port for other nodes is bound to, defaults to --listen")
+	clientBindPtr = flag.String("client-bind", "", "specifies the address the port for the user api is bound to, defaults to --listen")
+	advertisePtr = flag.String("advertise", "", "comma separated address[:port] other nodes reach this node at, the first one preferred, defaults to the addresses of the interfaces")
 	configPathPtr = flag.String("config", ".kvstoreconfig", "specifies the path for a configuration file")
+	fanoutPtr = flag.Int("fanout", protocol.DEFAULT_FANOUT, "specifies how many peers the node tries to stay connected to")
+	tlsPtr = flag.String("tls", string(protocol.TLS_OFF), "specifies whether connections use TLS: off, optional or required")
+	adminSocketPtr = flag.String("admin-socket", "", "specifies the path of the unix socket for admin commands, defaults to admin.sock in the configuration folder")
+	clientTLSPtr = flag.String("client-tls", "", "specifies whether the port for the user api uses TLS, defaults to --tls")
+	allowUnauthenticatedPtr = flag.Bool("allow-unauthenticated", false, "accepts and dials older nodes that do not prove their key, unless an allowlist is configured")
+	peersPtr = flag.String("peers", "", "comma separated address:port[@public key] of nodes to keep connected to, added to the peers file of the configuration")
 }
 
 func main() {
 	flag.Parse()
 
 	var serverPort string = *serverPortPtr
+	if *peerPortPtr != "" {
+		serverPort = *peerPortPtr
+	}
 	var configPath string = *configPathPtr
 
 	var nodeConfig config.ConfigData
@@ -45,11 +83,169 @@ func main() {
 		logger.Info(fmt.Sprintf("Configuration %s read successfully", configPath))
 	}
 
-	logger.Info(fmt.Sprintf("Server started: %s:%s", serverHostname, serverPort))
+	flagPeers, err := config.ParsePeerList(*peersPtr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	peers := config.MergePeers(nodeConfig.Peers, flagPeers)
 
-	var ctx context.AppContext = context.New(nodeConfig.Sk, serverHostname, serverPort)
+	advertised, err := advertisedFromFlags(serverPort)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	// the advertised port may be mapped, the listeners keep the bound one
+	advertisedHost, advertisedPort, _ := net.SplitHostPort(advertised[0])
+
+	var ctx context.AppContext = context.New(nodeConfig.Sk, advertisedHost, advertisedPort)
+	ctx.Addresses = advertised[1:]
+	ctx.AllowUnauthenticated = *allowUnauthenticatedPtr
+	if nodeConfig.AllowedKeys != nil {
+		ctx.AllowedKeys = make(map[string]bool)
+		for _, key := range nodeConfig.AllowedKeys {
+			ctx.AllowedKeys[hex.EncodeToString(key)] = true
+		}
+	}
 
-	go protocol.ReceiverStart(&ctx, serverPort)
+	ctx.Operators = make(map[string]bool)
+	for _, key := range nodeConfig.Operators {
+		ctx.Operators[hex.EncodeToString(key)] = true
+	}
+
+	listeners, err := listenersFromFlags(serverPort)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	listeners = append(listeners, protocol.Listener{
+		Socket: cmp.Or(*adminSocketPtr, configPath+"/"+protocol.ADMIN_SOCKET),
+		TLS:    protocol.TLS_OFF,
+		Admin:  true,
+	})
+	usesTLS := func(listener protocol.Listener) bool { return listener.TLS != protocol.TLS_OFF }
+	if slices.ContainsFunc(listeners, usesTLS) {
+		// peers are dialed the way the peer listener takes them
+		if err := protocol.ConfigureTLS(&ctx, listeners[0].TLS); err != nil {
+			logger.Fatal("Failed to create the TLS certificate", err)
+		}
+	}
+	logger.Info("Server started:", strings.Join(advertised, ", "))
+	for _, listener := range listeners {
+		logger.Info(describeListener(listener))
+	}
 
-	protocol.BroadcastReceiver(&ctx)
+	runCtx, stop := signal.NotifyContext(stdcontext.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// peers outlive the receiver so the broadcasts of the last requests
+	// still reach them
+	peersCtx, stopPeers := stdcontext.WithCancel(stdcontext.Background())
+	peersDone := make(chan struct{})
+	go func() {
+		protocol.BroadcastReceiver(peersCtx, &ctx)
+		close(peersDone)
+	}()
+	go protocol.StartMembership(peersCtx, &ctx, configPath+"/"+protocol.MEMBERS_FILE, *fanoutPtr)
+	for _, peer := range peers {
+		go protocol.KeepConnected(peersCtx, &ctx, peer.Address, peer.Port, peer.PublicKey)
+	}
+
+	go func() {
+		<-runCtx.Done()
+		stop() // a second signal kills the node right away
+		logger.Info("Shutting down")
+
+		time.AfterFunc(_SHUTDOWN_TIMEOUT, func() {
+			logger.Error("Shutdown did not finish in time")
+			os.Exit(1)
+		})
+	}()
+
+	if err := protocol.ReceiverStart(runCtx, &ctx, listeners...); err != nil {
+		logger.Fatal("Failed to listen", err)
+	}
+
+	stopPeers()
+	<-peersDone
+
+	// operations are only kept in memory, so there is no storage to flush
+	logger.Info("Shutdown complete")
+}
+
+// The peer listener comes first. The same port and address for peers and
+// clients is served by a single listener.
+func listenersFromFlags(peerPort string) ([]protocol.Listener, error) {
+	peerTLS, err := protocol.ParseTLSMode(*tlsPtr)
+	if err != nil {
+		return nil, err
+	}
+	clientTLS := peerTLS
+	if *clientTLSPtr != "" {
+		if clientTLS, err = protocol.ParseTLSMode(*clientTLSPtr); err != nil {
+			return nil, err
+		}
+	}
+
+	clientPort := *serverPortPtr
+	if *clientPortPtr != "" {
+		clientPort = *clientPortPtr
+	}
+
+	peers := protocol.Listener{Address: cmp.Or(*peerBindPtr, *listenPtr), Port: peerPort, TLS: peerTLS, Peers: true}
+	clients := protocol.Listener{Address: cmp.Or(*clientBindPtr, *listenPtr), Port: clientPort, TLS: clientTLS, Clients: true}
+
+	if peers.Port != clients.Port || peers.Address != clients.Address {
+		return []protocol.Listener{peers, clients}, nil
+	}
+	if peerTLS != clientTLS {
+		return nil, errors.New("Peers and clients share the port, so they must use the same TLS mode")
+	}
+	peers.Clients = true
+	return []protocol.Listener{peers}, nil
+}
+
+// The addresses are host:port, entries without a port take the one of the
+// peer listener. Without --advertise the node advertises the address its peer
+// port is bound to, or the addresses of its interfaces when bound to all.
+func advertisedFromFlags(peerPort string) ([]string, error) {
+	hosts := make([]string, 0)
+	if *advertisePtr != "" {
+		hosts = strings.Split(*advertisePtr, ",")
+	} else if bind := net.ParseIP(cmp.Or(*peerBindPtr, *listenPtr)); bind != nil && !bind.IsUnspecified() {
+		hosts = append(hosts, bind.String())
+	} else {
+		hosts = utils.Map(utils.InterfaceIPs(), net.IP.String)
+	}
+
+	advertised := make([]string, 0, len(hosts))
+	for _, entry := range hosts {
+		entry = strings.TrimSpace(entry)
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			// a bare address, IPv6 ones may be in brackets
+			host, port = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]"), peerPort
+		}
+		if host == "" || port == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid advertised address '%s'", entry))
+		}
+
+		address := net.JoinHostPort(host, port)
+		if !slices.Contains(advertised, address) {
+			advertised = append(advertised, address)
+		}
+	}
+
+	return advertised, nil
+}
+
+func describeListener(listener protocol.Listener) string {
+	if listener.Socket != "" {
+		return fmt.Sprintf("Listening for admin commands on %s", listener.Socket)
+	}
+
+	serving := "peers and clients"
+	if !listener.Clients {
+		serving = "peers"
+	} else if !listener.Peers {
+		serving = "clients"
+	}
+	return fmt.Sprintf("Listening for %s on %s port %s, TLS %s", serving, cmp.Or(listener.Address, "every interface"), listener.Port, listener.TLS)
 }
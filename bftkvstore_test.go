@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAdvertisedFromFlags(t *testing.T) {
+	defer func(advertise, listen, peerBind string) {
+		*advertisePtr, *listenPtr, *peerBindPtr = advertise, listen, peerBind
+	}(*advertisePtr, *listenPtr, *peerBindPtr)
+
+	tests := []struct {
+		name       string
+		advertise  string
+		listen     string
+		peerBind   string
+		advertised string // empty when the flags are invalid
+	}{
+		{"address without port", "203.0.113.1", "", "", "[203.0.113.1:8089]"},
+		{"mapped port and hostname", "203.0.113.1:9000, node.example", "", "", "[203.0.113.1:9000 node.example:8089]"},
+		{"IPv6 addresses", "::1,[2001:db8::1],[2001:db8::2]:9000", "", "", "[[::1]:8089 [2001:db8::1]:8089 [2001:db8::2]:9000]"},
+		{"duplicates", "203.0.113.1,203.0.113.1:8089", "", "", "[203.0.113.1:8089]"},
+		{"advertise over the bound address", "203.0.113.1", "192.0.2.1", "", "[203.0.113.1:8089]"},
+		{"bound address", "", "192.0.2.1", "", "[192.0.2.1:8089]"},
+		{"peer bind over listen", "", "192.0.2.1", "192.0.2.2", "[192.0.2.2:8089]"},
+		{"missing host", ":9000", "", "", ""},
+		{"empty entry", "203.0.113.1,", "", "", ""},
+	}
+
+	for _, test := range tests {
+		*advertisePtr, *listenPtr, *peerBindPtr = test.advertise, test.listen, test.peerBind
+
+		advertised, err := advertisedFromFlags("8089")
+		if test.advertised == "" && err == nil {
+			t.Error(test.name, "should be rejected but got", advertised)
+		}
+		if test.advertised != "" && (err != nil || fmt.Sprint(advertised) != test.advertised) {
+			t.Error(test.name, "expected", test.advertised, "but got", advertised, err)
+		}
+	}
+}
@@ -1,4 +1,25 @@
 #!/bin/bash
 
+# The first node is either given by the path of its admin socket (and any
+# port, like -), or by address and port when OPERATOR_KEY is the PEM file of
+# an operator key to sign the command with. The signature is only valid for
+# the node whose hex encoded public key is in NODE_KEY.
 
-echo `python3 ./cmds/sendcmd.py "${1}" "${2}" "CONN" "{\"Address\": \"${3}\", \"Port\": \"${4}\"}"`
+if [ -z "${OPERATOR_KEY}" ]; then
+	echo `python3 ./cmds/sendcmd.py "${1}" "${2}" "CONN" "{\"Address\": \"${3}\", \"Port\": \"${4}\"}"`
+	exit
+fi
+
+if [ -z "${NODE_KEY}" ]; then
+	echo "NODE_KEY must hold the public key of the node the command is signed for" >&2
+	exit 1
+fi
+
+TIMESTAMP=`date +%s`
+COMMAND=`mktemp`
+printf 'bftkvstore admin\n%s\nCONN\n%s\n%s\n%s' "${NODE_KEY}" "${3}" "${4}" "${TIMESTAMP}" > "${COMMAND}"
+SIGNATURE=`openssl pkeyutl -sign -inkey "${OPERATOR_KEY}" -rawin -in "${COMMAND}" | xxd -p -c 256`
+OPERATOR=`openssl pkey -in "${OPERATOR_KEY}" -pubout -outform DER | tail -c 32 | xxd -p -c 64`
+rm "${COMMAND}"
+
+echo `python3 ./cmds/sendcmd.py "${1}" "${2}" "CONN" "{\"Address\": \"${3}\", \"Port\": \"${4}\", \"Operator\": \"${OPERATOR}\", \"Timestamp\": ${TIMESTAMP}, \"Signature\": \"${SIGNATURE}\"}"`
@@ -1,7 +1,10 @@
 #!/bin/bash
 
+# admin socket of the node on 8089
+ADMIN_SOCKET=${ADMIN_SOCKET:-.kvstoreconfig/admin.sock}
 
-python3 ./cmds/sendcmd.py 'localhost' '8089' 'CONN' '{"Address": "localhost", "Port": "8079"}'
+
+python3 ./cmds/sendcmd.py "${ADMIN_SOCKET}" - 'CONN' '{"Address": "localhost", "Port": "8079"}'
 echo "Connected 8089 with 8079"
 
 KEY=`python3 ./cmds/sendcmd.py 'localhost' '8089' '/new' '{"type": "counter"}'`
@@ -1,11 +1,14 @@
 #!/bin/bash
 
+# admin socket of the node on 8089
+ADMIN_SOCKET=${ADMIN_SOCKET:-.kvstoreconfig/admin.sock}
+
 
 KEY=`python3 ./cmds/sendcmd.py "localhost" "8089" "/new" "{\"type\": \"counter\"}"`
 KEY=`echo ${KEY[@]:4} | jq -r ".key"`
 echo "Created counter with key \"${KEY}\""
 
-./cmds/connect.sh localhost 8089 localhost 8079
+./cmds/connect.sh "${ADMIN_SOCKET}" - localhost 8079
 echo "Connected 8089 with 8079"
 
 
@@ -1,5 +1,8 @@
 #!/bin/bash
 
+# admin socket of the node on 8089
+ADMIN_SOCKET=${ADMIN_SOCKET:-.kvstoreconfig/admin.sock}
+
 
 KEY=`python3 ./cmds/sendcmd.py "localhost" "8089" "/new" "{\"type\": \"gset\"}"`
 KEY=`echo ${KEY[@]:4} | jq -r ".key"`
@@ -7,7 +10,7 @@ echo "Created gset with key \"${KEY}\""
 
 echo `python3 ./cmds/sendcmd.py "localhost" "8089" "/add" "{\"key\": \"${KEY}\", \"value\": 5}"`
 
-./cmds/connect.sh localhost 8089 localhost 8079
+./cmds/connect.sh "${ADMIN_SOCKET}" - localhost 8079
 echo "Connected 8089 with 8079"
 
 sleep 0.2
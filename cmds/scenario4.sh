@@ -1,5 +1,8 @@
 #!/bin/bash
 
+# admin socket of the node on 8089
+ADMIN_SOCKET=${ADMIN_SOCKET:-.kvstoreconfig/admin.sock}
+
 
 KEY=`python3 ./cmds/sendcmd.py "localhost" "8079" "/new" "{\"type\": \"gset\"}"`
 KEY=`echo ${KEY[@]:4} | jq -r ".key"`
@@ -10,7 +13,7 @@ sleep 0.5
 echo "add 5 to 8079"
 echo `python3 ./cmds/sendcmd.py "localhost" "8079" "/add" "{\"key\": \"${KEY}\", \"value\": 5}"`
 echo
-./cmds/connect.sh localhost 8089 localhost 8079
+./cmds/connect.sh "${ADMIN_SOCKET}" - localhost 8079
 echo "Connected 8089 with 8079"
 
 sleep 0.1
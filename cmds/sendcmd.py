@@ -1,19 +1,77 @@
+import os
 import socket
+import ssl
 import time
 import sys
 
+FRAME_V2_MARKER = 0x02
+
+# nodes started with --tls take TLS connections when KV_TLS is set, their
+# certificates are self-signed so KV_TLS_KEY pins the expected public key
+ED25519_KEY_PREFIX = bytes.fromhex('302a300506032b6570032100')
+
+
+def print_reply(data):
+    if len(data) > 0:
+        if data[0] == FRAME_V2_MARKER:
+            print(data[1:5].decode('utf8') + data[9:].decode('utf8'))
+        else:
+            print(data[0:4].decode('utf8') + data[6:].decode('utf8'))
+
+
+def recv_exactly(s, size):
+    data = b''
+    while len(data) < size:
+        chunk = s.recv(size - len(data))
+        if len(chunk) == 0:
+            break
+        data += chunk
+    return data
+
+
+def tls_netcat(hostname, port, content, pinned_key):
+    context = ssl.SSLContext(ssl.PROTOCOL_TLS_CLIENT)
+    context.minimum_version = ssl.TLSVersion.TLSv1_3
+    context.check_hostname = False
+    context.verify_mode = ssl.CERT_NONE
+
+    s = context.wrap_socket(socket.create_connection((hostname, port)))
+    certificate = s.getpeercert(binary_form=True)
+    if pinned_key and ED25519_KEY_PREFIX + bytes.fromhex(pinned_key) not in certificate:
+        s.close()
+        sys.exit('The certificate of the node does not hold the pinned key')
+
+    # the connection stays open after the reply, so only one frame is read
+    s.sendall(content)
+    data = recv_exactly(s, 1)
+    if data == bytes([FRAME_V2_MARKER]):
+        data += recv_exactly(s, 8)
+        data += recv_exactly(s, int.from_bytes(data[5:9], byteorder='big'))
+    elif len(data) > 0:
+        data += recv_exactly(s, 5)
+        data += recv_exactly(s, int.from_bytes(data[4:6], byteorder='big'))
+    print_reply(data)
+    s.close()
+
 
 def netcat(hostname, port, content):
-    s = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-    s.connect((hostname, port))
+    # paths are the admin socket of a node
+    if '/' in hostname:
+        s = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        s.connect(hostname)
+    else:
+        s = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        s.connect((hostname, port))
     s.sendall(content)
     time.sleep(0.5)
     s.shutdown(socket.SHUT_WR)
+    data = b''
     while 1:
-        data = s.recv(1024)
-        if len(data) == 0:
+        chunk = s.recv(1024)
+        if len(chunk) == 0:
             break
-        print(data[0:4].decode('utf8') + data[6:].decode('utf8'))
+        data += chunk
+    print_reply(data)
     s.close()
 
 
@@ -24,20 +82,28 @@ def main():
         return
 
     hostname = args[0]
-    port = int(args[1])
+    port = int(args[1]) if args[1].isdigit() else 0
     header = args[2]
     content = args[3]
 
-    encoded_content_size = (len(content)).to_bytes(
-        2,
-        byteorder='big'
-    )
+    encoded_content = content.encode()
+
+    # bodies that do not fit a 16 bit length use the second framing version
+    if len(encoded_content) > 0xFFFF:
+        frame = bytes([FRAME_V2_MARKER]) + header.encode() + \
+            len(encoded_content).to_bytes(4, byteorder='big')
+    else:
+        frame = header.encode() + \
+            len(encoded_content).to_bytes(2, byteorder='big')
 
-    netcat(
-        hostname,
-        port,
-        header.encode() + encoded_content_size + content.encode()
-    )
+    if os.environ.get('KV_TLS'):
+        tls_netcat(hostname, port, frame + encoded_content, os.environ.get('KV_TLS_KEY'))
+    else:
+        netcat(
+            hostname,
+            port,
+            frame + encoded_content
+        )
 
 
 if __name__ == "__main__":
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const ALLOWLIST_FILE = "allowlist"
+
+// Without an allowlist file any node can connect, otherwise only the nodes
+// proving one of its keys. The file lists a hex encoded public key per line,
+// lines starting with # are comments.
+func readAllowlist(path string) (keys []ed25519.PublicKey, err error) {
+	return readKeys(path, "allowlist")
+}
+
+// Reads a file of hex encoded public keys, nil if it does not exist
+func readKeys(path string, name string) (keys []ed25519.PublicKey, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read the %s file: %s", name, err))
+	}
+	defer file.Close()
+
+	keys = make([]ed25519.PublicKey, 0)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New(fmt.Sprintf("Line %d of the %s file is not a public key", lineNumber, name))
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, scanner.Err()
+}
@@ -14,7 +14,10 @@ import (
 )
 
 type ConfigData struct {
-	Sk ed25519.PrivateKey // private key
+	Sk          ed25519.PrivateKey  // private key
+	Peers       []PeerConfig        // nodes to keep connected to
+	AllowedKeys []ed25519.PublicKey // nodes allowed to connect, nil allows any
+	Operators   []ed25519.PublicKey // keys that sign admin commands
 }
 
 func ReadConfig(path string) (config ConfigData, err error) {
@@ -50,8 +53,26 @@ func ReadConfig(path string) (config ConfigData, err error) {
 		return config, errors.New(fmt.Sprintf("Failed to parse the private.pem key.\n"))
 	}
 
+	peers, err := readPeers(path + "/" + PEERS_FILE)
+	if err != nil {
+		return config, err
+	}
+
+	allowedKeys, err := readAllowlist(path + "/" + ALLOWLIST_FILE)
+	if err != nil {
+		return config, err
+	}
+
+	operators, err := readOperators(path + "/" + OPERATORS_FILE)
+	if err != nil {
+		return config, err
+	}
+
 	return ConfigData{
-		Sk: secretkey.(ed25519.PrivateKey),
+		Sk:          secretkey.(ed25519.PrivateKey),
+		Peers:       peers,
+		AllowedKeys: allowedKeys,
+		Operators:   operators,
 	}, nil
 }
 
@@ -81,6 +102,7 @@ func WriteConfig(folder string) (config ConfigData) {
 	}
 
 	return ConfigData{
-		Sk: secretkey,
+		Sk:    secretkey,
+		Peers: make([]PeerConfig, 0),
 	}
 }
@@ -0,0 +1,12 @@
+package config
+
+import "crypto/ed25519"
+
+const OPERATORS_FILE = "operators"
+
+// Operators can send admin commands, like CONN, to the node from anywhere by
+// signing them. The file has the format of the allowlist, without it admin
+// commands are only taken on the admin socket.
+func readOperators(path string) (keys []ed25519.PublicKey, err error) {
+	return readKeys(path, "operators")
+}
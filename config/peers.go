@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const PEERS_FILE = "peers"
+
+// A node to dial on boot and keep connected to. The peers file of the
+// configuration folder lists one per line as
+//
+//	address:port [public key]
+//
+// where the optional public key is hex encoded, lines starting with # are
+// comments. IPv6 addresses go between brackets, like [::1]:8089.
+type PeerConfig struct {
+	Address   string
+	Port      string
+	PublicKey ed25519.PublicKey // nil when any key is accepted
+}
+
+func ParsePeer(hostPort string, publicKey string) (peer PeerConfig, err error) {
+	peer.Address, peer.Port, err = net.SplitHostPort(hostPort)
+	if err != nil {
+		return peer, errors.New(fmt.Sprintf("Invalid peer address %s: %s", hostPort, err))
+	}
+	if peer.Address == "" || peer.Port == "" {
+		return peer, errors.New(fmt.Sprintf("Invalid peer address %s: expected address:port", hostPort))
+	}
+
+	if publicKey != "" {
+		key, err := hex.DecodeString(publicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return peer, errors.New(fmt.Sprintf("Invalid public key for peer %s", hostPort))
+		}
+		peer.PublicKey = key
+	}
+
+	return peer, nil
+}
+
+// Parses a comma separated list of address:port entries, each optionally
+// followed by @ and the public key of the peer
+func ParsePeerList(list string) (peers []PeerConfig, err error) {
+	peers = make([]PeerConfig, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		hostPort, publicKey, _ := strings.Cut(entry, "@")
+		peer, err := ParsePeer(hostPort, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+func readPeers(path string) (peers []PeerConfig, err error) {
+	peers = make([]PeerConfig, 0)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return peers, nil
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read the peers file: %s", err))
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, errors.New(fmt.Sprintf("Line %d of the peers file has too many fields", lineNumber))
+		}
+		fields = append(fields, "")
+
+		peer, err := ParsePeer(fields[0], fields[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Line %d of the peers file: %s", lineNumber, err))
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, scanner.Err()
+}
+
+// Adds the peers of other to the peers, the entries of other replace the ones
+// with the same address
+func MergePeers(peers []PeerConfig, other []PeerConfig) []PeerConfig {
+	merged := make([]PeerConfig, 0, len(peers)+len(other))
+	indexes := make(map[string]int)
+	for _, peer := range append(append([]PeerConfig{}, peers...), other...) {
+		name := net.JoinHostPort(peer.Address, peer.Port)
+		if idx, exists := indexes[name]; exists {
+			merged[idx] = peer
+			continue
+		}
+		indexes[name] = len(merged)
+		merged = append(merged, peer)
+	}
+	return merged
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func peerNames(peers []PeerConfig) string {
+	names := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		names = append(names, fmt.Sprint(peer.Address, " ", peer.Port, " ", hex.EncodeToString(peer.PublicKey)))
+	}
+	return fmt.Sprint(names)
+}
+
+func TestReadPeers(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	key := hex.EncodeToString(publicKey)
+
+	tests := []struct {
+		name  string
+		file  string
+		peers string // empty when the file is invalid
+	}{
+		{"empty", "", "[]"},
+		{"comments and blank lines", "# peers\n\n  \n127.0.0.1:8089\n", "[127.0.0.1 8089 ]"},
+		{"with a key", "node.example:8089 " + key + "\n[::1]:8090", "[node.example 8089 " + key + " ::1 8090 ]"},
+		{"too many fields", "127.0.0.1:8089 " + key + " extra", ""},
+		{"missing port", "127.0.0.1", ""},
+		{"empty address", ":8089", ""},
+		{"short key", "127.0.0.1:8089 " + key[:62], ""},
+		{"key not hex", "127.0.0.1:8089 " + key[:62] + "zz", ""},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), PEERS_FILE)
+		if err := os.WriteFile(path, []byte(test.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		peers, err := readPeers(path)
+		if test.peers == "" && err == nil {
+			t.Error(test.name, "should be rejected but got", peerNames(peers))
+		}
+		if test.peers != "" && (err != nil || peerNames(peers) != test.peers) {
+			t.Error(test.name, "expected", test.peers, "but got", peerNames(peers), err)
+		}
+	}
+
+	if peers, err := readPeers(filepath.Join(t.TempDir(), PEERS_FILE)); err != nil || len(peers) != 0 {
+		t.Error("Expected no peers without a peers file but got", peers, err)
+	}
+}
+
+func TestParsePeerList(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	key := hex.EncodeToString(publicKey)
+
+	tests := []struct {
+		name  string
+		list  string
+		peers string // empty when the list is invalid
+	}{
+		{"empty", "", "[]"},
+		{"spaces and empty entries", " 127.0.0.1:8089 ,, [::1]:8090 ,", "[127.0.0.1 8089  ::1 8090 ]"},
+		{"with a key", "127.0.0.1:8089@" + key, "[127.0.0.1 8089 " + key + "]"},
+		{"invalid key", "127.0.0.1:8089@" + key[:10], ""},
+		{"missing port", "127.0.0.1:8089,127.0.0.1", ""},
+	}
+
+	for _, test := range tests {
+		peers, err := ParsePeerList(test.list)
+		if test.peers == "" && err == nil {
+			t.Error(test.name, "should be rejected but got", peerNames(peers))
+		}
+		if test.peers != "" && (err != nil || peerNames(peers) != test.peers) {
+			t.Error(test.name, "expected", test.peers, "but got", peerNames(peers), err)
+		}
+	}
+}
+
+func TestMergePeers(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	key := hex.EncodeToString(publicKey)
+
+	fromFile, _ := ParsePeerList("127.0.0.1:8089,127.0.0.1:8090,[::1]:8089")
+	fromFlag, _ := ParsePeerList("127.0.0.1:8090@" + key + ",127.0.0.1:8091,127.0.0.1:8091")
+
+	merged := MergePeers(fromFile, fromFlag)
+	expected := "[127.0.0.1 8089  127.0.0.1 8090 " + key + " ::1 8089  127.0.0.1 8091 ]"
+	if peerNames(merged) != expected {
+		t.Error("Expected the flag to replace the entries of the file but got", peerNames(merged))
+	}
+	if len(fromFile) != 3 || fromFile[1].PublicKey != nil {
+		t.Error("Expected the merge to leave the peers of the file unchanged")
+	}
+}
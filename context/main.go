@@ -4,22 +4,29 @@ import (
 	"bftkvstore/storage"
 	"crypto/ed25519"
 	"net"
-	"sync"
 )
 
 type Node struct {
 	Address string
 	Port    string
 	Conn    net.Conn
+	Dialed  bool // the connection was opened by this node
+	Redial  bool // the node is redialed when the connection is lost
+
+	ExpectedKey ed25519.PublicKey // when redialing, the node must have this key
 }
 
 type AppContext struct {
-	Lock      sync.Mutex
 	Secretkey ed25519.PrivateKey
 	Address   string
 	Port      string
-	NewNodes  []Node
-	Storage   storage.Storage
+	Addresses []string  // other host:port the node can be reached at
+	NewNodes  chan Node // connections to other nodes, served by the broadcast receiver
+
+	AllowedKeys          map[string]bool // hex encoded keys of the nodes allowed to connect, nil allows any
+	AllowUnauthenticated bool            // older nodes that do not prove their key may connect
+	Operators            map[string]bool // hex encoded keys that sign admin commands
+	Storage              storage.Storage
 }
 
 func New(secretkey ed25519.PrivateKey, hostname string, port string) AppContext {
@@ -27,20 +34,11 @@ func New(secretkey ed25519.PrivateKey, hostname string, port string) AppContext
 		Secretkey: secretkey,
 		Address:   hostname,
 		Port:      port,
-		NewNodes:  make([]Node, 0),
+		NewNodes:  make(chan Node),
 		Storage:   storage.Init(),
 	}
 }
 
-func (ctx *AppContext) AddNewNode(address string, port string, conn net.Conn) {
-	ctx.Lock.Lock()
-	defer ctx.Lock.Unlock()
-
-	for _, node := range ctx.NewNodes {
-		if node.Address == address && node.Port == port {
-			return
-		}
-	}
-
-	ctx.NewNodes = append(ctx.NewNodes, Node{Address: address, Port: port, Conn: conn})
+func (ctx *AppContext) AddNewNode(address string, port string, conn net.Conn, dialed bool) {
+	ctx.NewNodes <- Node{Address: address, Port: port, Conn: conn, Dialed: dialed, Redial: dialed}
 }
@@ -0,0 +1,197 @@
+package crdts
+
+import (
+	"crypto/ed25519"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The alias registry is a single replicated key that every node creates on
+// startup, so it has no "new" operation and its claims may have no preds
+const ALIAS_REGISTRY_KEY = "aliases"
+
+var aliasNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+(/[a-zA-Z0-9_.-]+)*$`)
+var keyRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type AliasClaim struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type AliasRegistry struct {
+	Owners  map[string]string `json:"owners"`  // namespace -> owner public key
+	Aliases map[string]string `json:"aliases"` // name -> key
+}
+
+// The name of the registry itself is reserved
+func IsValidAliasName(name string) bool {
+	return name != ALIAS_REGISTRY_KEY && len(name) <= 128 && aliasNameRegex.MatchString(name) && !keyRegex.MatchString(name)
+}
+
+// The namespace of an alias is the segment before its first '/'
+func AliasNamespace(name string) string {
+	namespace, _, _ := strings.Cut(name, "/")
+	return namespace
+}
+
+func ClaimAliasOp(secretkey ed25519.PrivateKey, name string, key string, preds []SignedOperation) ([]byte, error) {
+	var hashed_preds []string = make([]string, len(preds))
+	for idx, pred := range preds {
+		hashed_preds[idx] = HashOperation(pred)
+	}
+
+	return SignOperation(secretkey, Operation{
+		Op:    "claim",
+		Preds: hashed_preds,
+		Crdt:  AliasClaim{Name: name, Key: key},
+		Type:  CRDT_ALIAS,
+	})
+}
+
+type aliasRegistryReducer struct{ nodes map[string]graphNode }
+
+func (r *aliasRegistryReducer) add(node graphNode) {
+	r.nodes[node.hash] = node
+}
+
+// Claims are applied in a topological order of the DAG where concurrent
+// operations are ordered by hash. The owner of a namespace is the author of
+// its first claim, unless a later claim supersedes it, and only the owner's
+// first claim on a name is kept, so every replica with the same operations
+// converges to the same registry.
+func (r *aliasRegistryReducer) value() any {
+	registry := AliasRegistry{
+		Owners:  make(map[string]string),
+		Aliases: make(map[string]string),
+	}
+
+	order := r.topologicalOrder()
+	descendants := make(map[string]map[string]bool)
+
+	ownerClaims := make(map[string]string) // namespace -> hash of the claim of the owner
+	for _, hash := range order {
+		claim, ok := readAliasClaim(r.nodes[hash].value)
+		if !ok {
+			continue
+		}
+
+		namespace := AliasNamespace(claim.Name)
+		ownerClaim, owned := ownerClaims[namespace]
+		if !owned || (r.nodes[ownerClaim].author != r.nodes[hash].author && r.supersedes(hash, ownerClaim, descendants)) {
+			ownerClaims[namespace] = hash
+		}
+	}
+	for namespace, hash := range ownerClaims {
+		registry.Owners[namespace] = r.nodes[hash].author
+	}
+
+	for _, hash := range order {
+		node := r.nodes[hash]
+		if claim, ok := readAliasClaim(node.value); ok {
+			_, taken := registry.Aliases[claim.Name]
+			if !taken && registry.Owners[AliasNamespace(claim.Name)] == node.author {
+				registry.Aliases[claim.Name] = claim.Key
+			}
+		}
+	}
+
+	return registry
+}
+
+func (r *aliasRegistryReducer) topologicalOrder() []string {
+	pending := make(map[string]int)
+	succs := make(map[string][]string)
+	ready := make([]string, 0)
+
+	for hash, node := range r.nodes {
+		for _, pred := range node.value.Preds {
+			if _, exists := r.nodes[pred]; exists {
+				pending[hash] += 1
+				succs[pred] = append(succs[pred], hash)
+			}
+		}
+		if pending[hash] == 0 {
+			ready = append(ready, hash)
+		}
+	}
+
+	order := make([]string, 0, len(r.nodes))
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		hash := ready[0]
+		ready = ready[1:]
+		order = append(order, hash)
+
+		for _, succ := range succs[hash] {
+			pending[succ] -= 1
+			if pending[succ] == 0 {
+				ready = append(ready, succ)
+			}
+		}
+	}
+	return order
+}
+
+// A claim never supersedes a claim it comes after. Concurrent claims are
+// told apart by the other nodes that built on them: a claim that other nodes
+// built on without knowing of its rival was there first, so a claim made
+// late with stale or no preds loses to it, whatever its hash. Otherwise the
+// claim applied first stays.
+func (r *aliasRegistryReducer) supersedes(claim string, rival string, descendants map[string]map[string]bool) bool {
+	if r.descendants(rival, descendants)[claim] {
+		return false
+	}
+	return r.witnessed(claim, rival, descendants) && !r.witnessed(rival, claim, descendants)
+}
+
+// Whether a node other than the authors of both claims built on the claim
+// without knowing of the rival
+func (r *aliasRegistryReducer) witnessed(claim string, rival string, descendants map[string]map[string]bool) bool {
+	rivalDescendants := r.descendants(rival, descendants)
+	for hash := range r.descendants(claim, descendants) {
+		author := r.nodes[hash].author
+		if !rivalDescendants[hash] && author != r.nodes[claim].author && author != r.nodes[rival].author {
+			return true
+		}
+	}
+	return false
+}
+
+// The operations that have the node as an ancestor, computed once per node
+func (r *aliasRegistryReducer) descendants(hash string, cache map[string]map[string]bool) map[string]bool {
+	if found, ok := cache[hash]; ok {
+		return found
+	}
+
+	found := make(map[string]bool)
+	stack := []string{hash}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, succ := range r.nodes[current].succs {
+			if _, exists := r.nodes[succ]; exists && !found[succ] {
+				found[succ] = true
+				stack = append(stack, succ)
+			}
+		}
+	}
+	cache[hash] = found
+	return found
+}
+
+func readAliasClaim(op Operation) (claim AliasClaim, ok bool) {
+	if op.Op != "claim" {
+		return claim, false
+	}
+
+	payload, ok := op.Crdt.(map[string]interface{})
+	if !ok {
+		return claim, false
+	}
+
+	claim.Name, _ = payload["name"].(string)
+	claim.Key, _ = payload["key"].(string)
+
+	return claim, IsValidAliasName(claim.Name) && keyRegex.MatchString(claim.Key)
+}
@@ -0,0 +1,144 @@
+package crdts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+type aliasTestNode struct {
+	secretkey ed25519.PrivateKey
+	publicKey string
+}
+
+func newAliasTestNodes(names ...string) map[string]aliasTestNode {
+	nodes := make(map[string]aliasTestNode)
+	for _, name := range names {
+		publicKey, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+		nodes[name] = aliasTestNode{secretkey: secretkey, publicKey: hex.EncodeToString(publicKey)}
+	}
+	return nodes
+}
+
+// Claims the alias for a random key
+func claimAlias(t *testing.T, node aliasTestNode, name string, preds ...SignedOperation) SignedOperation {
+	target := make([]byte, 32)
+	rand.Read(target)
+	op, err := ClaimAliasOp(node.secretkey, name, hex.EncodeToString(target), preds)
+	checkErr(t, err)
+	return op
+}
+
+func aliasKeyOf(t *testing.T, op SignedOperation) string {
+	read, err := ReadOperation(op)
+	checkErr(t, err)
+	claim, ok := readAliasClaim(read)
+	if !ok {
+		t.Fatal("Not a claim", read)
+	}
+	return claim.Key
+}
+
+// Calculates the registry from every order of the operations, which must all
+// give the same registry
+func aliasRegistryOf(t *testing.T, ops ...SignedOperation) AliasRegistry {
+	var registry AliasRegistry
+	for idx := range ops {
+		rotated := append(slices.Clone(ops[idx:]), ops[:idx]...)
+		result := CalculateOperations(rotated, CRDT_ALIAS)
+		if idx > 0 && fmt.Sprint(result.Value) != fmt.Sprint(registry) {
+			t.Fatal("The registry depends on the order of the operations:", result.Value, registry)
+		}
+		registry = result.Value.(AliasRegistry)
+	}
+	return registry
+}
+
+func TestAliasOwnerOnlyNames(t *testing.T) {
+	nodes := newAliasTestNodes("owner", "other")
+
+	op0 := claimAlias(t, nodes["owner"], "ns/a")
+	op1 := claimAlias(t, nodes["other"], "ns/b", op0)
+	op2 := claimAlias(t, nodes["owner"], "ns/b", op1)
+	op3 := claimAlias(t, nodes["other"], "other", op2)
+	op4 := claimAlias(t, nodes["owner"], "ns/a", op3)
+
+	registry := aliasRegistryOf(t, op0, op1, op2, op3, op4)
+
+	if registry.Owners["ns"] != nodes["owner"].publicKey || registry.Owners["other"] != nodes["other"].publicKey {
+		t.Error("Expected the first claim of each namespace to make its owner but got", registry.Owners)
+	}
+	if registry.Aliases["ns/a"] != aliasKeyOf(t, op0) || registry.Aliases["ns/b"] != aliasKeyOf(t, op2) {
+		t.Error("Expected only the first claims of the owner on its names but got", registry.Aliases)
+	}
+	if registry.Aliases["other"] != aliasKeyOf(t, op3) || len(registry.Aliases) != 3 {
+		t.Error("Expected 3 aliases but got", registry.Aliases)
+	}
+}
+
+func TestAliasLateClaim(t *testing.T) {
+	nodes := newAliasTestNodes("owner", "witness", "attacker")
+
+	owned := claimAlias(t, nodes["owner"], "ns")
+	witnessed := claimAlias(t, nodes["witness"], "witness", owned)
+
+	// whatever the hash of the late claim, before or after the owner's one
+	for _, smaller := range []bool{true, false} {
+		late := claimAlias(t, nodes["attacker"], "ns/a")
+		for (HashOperation(late) < HashOperation(owned)) != smaller {
+			late = claimAlias(t, nodes["attacker"], "ns/a")
+		}
+		after := claimAlias(t, nodes["witness"], "witness/after", witnessed, late)
+
+		registry := aliasRegistryOf(t, owned, witnessed, late, after)
+
+		if registry.Owners["ns"] != nodes["owner"].publicKey {
+			t.Error("Expected the late claim with empty preds to lose the namespace but got", registry.Owners)
+		}
+		if _, taken := registry.Aliases["ns/a"]; taken || registry.Aliases["ns"] != aliasKeyOf(t, owned) {
+			t.Error("Expected only the aliases of the owner but got", registry.Aliases)
+		}
+	}
+}
+
+func TestAliasConcurrentClaims(t *testing.T) {
+	nodes := newAliasTestNodes("first", "second", "witness")
+
+	first := claimAlias(t, nodes["first"], "ns/a")
+	second := claimAlias(t, nodes["second"], "ns/b")
+
+	registry := aliasRegistryOf(t, first, second)
+	owner := registry.Owners["ns"]
+	if owner != nodes["first"].publicKey && owner != nodes["second"].publicKey {
+		t.Fatal("Expected one of the claims to own the namespace but got", registry.Owners)
+	}
+	if len(registry.Aliases) != 1 || (owner == nodes["first"].publicKey) != (registry.Aliases["ns/a"] == aliasKeyOf(t, first)) {
+		t.Error("Expected only the alias of the owner but got", registry.Aliases)
+	}
+
+	// the claim another node built on wins, whatever the hashes
+	witnessed := claimAlias(t, nodes["witness"], "witness", second)
+	registry = aliasRegistryOf(t, first, second, witnessed)
+	if registry.Owners["ns"] != nodes["second"].publicKey || registry.Aliases["ns/b"] != aliasKeyOf(t, second) {
+		t.Error("Expected the witnessed claim to own the namespace but got", registry.Owners, registry.Aliases)
+	}
+	if _, taken := registry.Aliases["ns/a"]; taken {
+		t.Error("Expected the alias of the losing claim to be dropped")
+	}
+}
+
+func TestAliasRegistryNameReserved(t *testing.T) {
+	nodes := newAliasTestNodes("node")
+
+	if IsValidAliasName(ALIAS_REGISTRY_KEY) {
+		t.Error("Expected the name of the registry to be reserved")
+	}
+
+	registry := aliasRegistryOf(t, claimAlias(t, nodes["node"], ALIAS_REGISTRY_KEY))
+	if len(registry.Owners) != 0 || len(registry.Aliases) != 0 {
+		t.Error("Expected the claim on the name of the registry to be ignored but got", registry)
+	}
+}
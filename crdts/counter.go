@@ -35,3 +35,7 @@ func DecCounterOp(secretkey ed25519.PrivateKey, val int, preds []SignedOperation
 		Type:  CRDT_COUNTER,
 	})
 }
+
+func NewCounterOp(secretkey ed25519.PrivateKey) (op []byte, id []byte, err error) {
+	return NewCRDT(CRDT_COUNTER, secretkey)
+}
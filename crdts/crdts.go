@@ -15,8 +15,11 @@ const (
 	CRDT_COUNTER CRDT_TYPE = "counter"
 	CRDT_GSET    CRDT_TYPE = "gset"
 	CRDT_2PSET   CRDT_TYPE = "2pset"
+	CRDT_ALIAS   CRDT_TYPE = "alias" // only used by the alias registry
 )
 
+var ErrUnknownCrdtType = errors.New("There is no crdt of the given type")
+
 func isValidCrdtType(crdtType CRDT_TYPE) bool {
 	switch crdtType {
 	case CRDT_COUNTER, CRDT_GSET, CRDT_2PSET:
@@ -64,7 +67,7 @@ func NewCRDT(crdtType CRDT_TYPE, secretkey ed25519.PrivateKey) (op []byte, id []
 	if isValidCrdtType(crdtType) {
 		op, id, err = createCrdtOp(crdtType, secretkey)
 	} else {
-		err = errors.New(fmt.Sprint("There is no crdt of type", crdtType))
+		err = fmt.Errorf("%w: %s", ErrUnknownCrdtType, crdtType)
 	}
 
 	return
@@ -48,21 +48,37 @@ func TestCounterOperations(t *testing.T) {
 	}
 
 	op0, _, err := NewCounterOp(keys["john"])
+	checkErr(t, err)
 	op1, err := IncCounterOp(keys["alice"], 4, []SignedOperation{op0})
+	checkErr(t, err)
 	op2, err := DecCounterOp(keys["john"], 3, []SignedOperation{op0})
+	checkErr(t, err)
 	op3, err := IncCounterOp(keys["alice"], 5, []SignedOperation{op1, op2})
+	checkErr(t, err)
 	op4, err := IncCounterOp(keys["alice"], 7, []SignedOperation{op3})
+	checkErr(t, err)
 	op5, err := IncCounterOp(keys["john"], 1, []SignedOperation{op4})
+	checkErr(t, err)
 	op6, err := DecCounterOp(keys["john"], 3, []SignedOperation{op4})
 	checkErr(t, err)
 
+	// out of order and with a duplicate
 	result := CalculateOperations([]SignedOperation{op0, op2, op1, op4, op3, op6, op5, op6}, CRDT_COUNTER)
 
-	fmt.Println("heads:", result.Heads)
-	fmt.Println("value:", result.Value)
-	fmt.Println("predecessors missing:", result.PredsMissing)
+	if fmt.Sprint(result.Value) != "11" {
+		t.Error("Expected the counter to be 11 but it is", result.Value)
+	}
+	if len(result.PredsMissing) != 0 {
+		t.Error("Expected no missing predecessors but got", result.PredsMissing)
+	}
 
-	t.Fail()
+	heads := make(map[string]bool)
+	for _, head := range result.Heads {
+		heads[HashOperation(head)] = true
+	}
+	if len(heads) != 2 || !heads[HashOperation(op5)] || !heads[HashOperation(op6)] {
+		t.Error("Expected the last two operations as heads but got", len(result.Heads), "heads")
+	}
 }
 
 func checkErr(t *testing.T, err error) {
@@ -0,0 +1,382 @@
+package crdts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// The content of a signed operation starts with its format. Operations signed
+// as JSON start with '{' and are still accepted, new ones are signed as the
+// canonical CBOR (RFC 8949) map
+//
+//	{"crdt": payload, "nonce": text, "op": text, "preds": [bytes], "type": text}
+//
+// where preds are the raw 32 byte hashes and the payload holds the JSON data
+// model. The encoding is canonical so every implementation signs, and hashes,
+// the same bytes for the same operation:
+//   - lengths are definite and as short as possible
+//   - map keys are text and sorted by their encoded bytes, without duplicates
+//   - numbers are IEEE 754 doubles; integral ones within ±2^53 are encoded as
+//     integers, the rest as 64 bit floats, NaN and infinities are not allowed
+//   - text is valid UTF-8 and byte strings only appear in preds
+//
+// Contents that decode but are not in the canonical form are rejected. The
+// vectors in testdata/vectors.json show valid and invalid encodings.
+const (
+	OP_FORMAT_JSON byte = '{'
+	OP_FORMAT_CBOR byte = 0x01
+)
+
+const (
+	_CBOR_UINT   byte = 0
+	_CBOR_NEGINT byte = 1
+	_CBOR_BYTES  byte = 2
+	_CBOR_TEXT   byte = 3
+	_CBOR_ARRAY  byte = 4
+	_CBOR_MAP    byte = 5
+	_CBOR_SIMPLE byte = 7
+
+	_CBOR_FALSE   byte = 20
+	_CBOR_TRUE    byte = 21
+	_CBOR_NULL    byte = 22
+	_CBOR_FLOAT64 byte = 27
+
+	_CBOR_MAX_DEPTH = 64
+
+	// integers beyond this magnitude are not exact as doubles
+	_CBOR_MAX_SAFE_INT = 1 << 53
+)
+
+var errMalformedCbor = errors.New("Malformed binary operation")
+
+func encodeOperation(op Operation) ([]byte, error) {
+	payload, err := normalizePayload(op.Crdt)
+	if err != nil {
+		return nil, err
+	}
+
+	preds := make([]any, len(op.Preds))
+	for idx, pred := range op.Preds {
+		if preds[idx], err = hex.DecodeString(pred); err != nil {
+			return nil, err
+		}
+	}
+
+	content := []byte{OP_FORMAT_CBOR}
+	return appendCbor(content, map[string]any{
+		"crdt":  payload,
+		"nonce": op.Nonce,
+		"op":    op.Op,
+		"preds": preds,
+		"type":  string(op.Type),
+	})
+}
+
+func decodeOperation(content []byte) (op Operation, err error) {
+	if len(content) == 0 || content[0] != OP_FORMAT_CBOR {
+		return op, errMalformedCbor
+	}
+
+	value, rest, err := readCbor(content[1:], 0)
+	if err != nil {
+		return op, err
+	}
+	if len(rest) != 0 {
+		return op, errMalformedCbor
+	}
+	defer func() {
+		if err == nil {
+			err = checkCanonical(op, content)
+		}
+	}()
+
+	fields, ok := value.(map[string]any)
+	if !ok || len(fields) != 5 {
+		return op, errMalformedCbor
+	}
+
+	var isText [3]bool
+	op.Op, isText[0] = fields["op"].(string)
+	op.Nonce, isText[1] = fields["nonce"].(string)
+	var crdtType string
+	crdtType, isText[2] = fields["type"].(string)
+	op.Type = CRDT_TYPE(crdtType)
+	if !isText[0] || !isText[1] || !isText[2] {
+		return op, errMalformedCbor
+	}
+
+	preds, ok := fields["preds"].([]any)
+	if !ok {
+		return op, errMalformedCbor
+	}
+	op.Preds = make([]string, len(preds))
+	for idx, pred := range preds {
+		predBytes, ok := pred.([]byte)
+		if !ok || len(predBytes) != 32 {
+			return op, errMalformedCbor
+		}
+		op.Preds[idx] = hex.EncodeToString(predBytes)
+	}
+
+	crdt, exists := fields["crdt"]
+	if !exists || containsBytes(crdt) {
+		return op, errMalformedCbor
+	}
+	op.Crdt = crdt
+
+	return op, nil
+}
+
+func checkCanonical(op Operation, content []byte) error {
+	canonical, err := encodeOperation(op)
+	if err != nil || !bytes.Equal(canonical, content) {
+		return errors.New("The binary operation is not in canonical form")
+	}
+	return nil
+}
+
+// Converts the payload to the JSON data model (maps, slices, strings, numbers,
+// booleans and nil), the same shape it has after being read back
+func normalizePayload(payload any) (any, error) {
+	serialized, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(serialized))
+	decoder.UseNumber()
+
+	var normalized any
+	err = decoder.Decode(&normalized)
+	return normalized, err
+}
+
+func containsBytes(value any) bool {
+	switch v := value.(type) {
+	case []byte:
+		return true
+	case []any:
+		for _, elem := range v {
+			if containsBytes(elem) {
+				return true
+			}
+		}
+	case map[string]any:
+		for _, elem := range v {
+			if containsBytes(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func appendCborHead(buf []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(buf, major<<5|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(buf, major<<5|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major<<5|27), arg)
+	}
+}
+
+func appendCborInt(buf []byte, v int64) []byte {
+	if v < 0 {
+		return appendCborHead(buf, _CBOR_NEGINT, uint64(-(v + 1)))
+	}
+	return appendCborHead(buf, _CBOR_UINT, uint64(v))
+}
+
+func appendCborFloat(buf []byte, v float64) ([]byte, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, errors.New("Non finite numbers can not be encoded")
+	}
+
+	// integral numbers are always integers, so 1 and 1.0 encode the same
+	if v == math.Trunc(v) && math.Abs(v) <= _CBOR_MAX_SAFE_INT {
+		return appendCborInt(buf, int64(v)), nil
+	}
+
+	return binary.BigEndian.AppendUint64(append(buf, _CBOR_SIMPLE<<5|_CBOR_FLOAT64), math.Float64bits(v)), nil
+}
+
+func appendCbor(buf []byte, value any) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, _CBOR_SIMPLE<<5|_CBOR_NULL), nil
+	case bool:
+		if v {
+			return append(buf, _CBOR_SIMPLE<<5|_CBOR_TRUE), nil
+		}
+		return append(buf, _CBOR_SIMPLE<<5|_CBOR_FALSE), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil && -_CBOR_MAX_SAFE_INT <= i && i <= _CBOR_MAX_SAFE_INT {
+			return appendCborInt(buf, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendCborFloat(buf, f)
+	case float64:
+		return appendCborFloat(buf, v)
+	case int:
+		return appendCborFloat(buf, float64(v))
+	case string:
+		if !utf8.ValidString(v) {
+			return nil, errors.New("Text must be valid UTF-8")
+		}
+		return append(appendCborHead(buf, _CBOR_TEXT, uint64(len(v))), v...), nil
+	case []byte:
+		return append(appendCborHead(buf, _CBOR_BYTES, uint64(len(v))), v...), nil
+	case []any:
+		buf = appendCborHead(buf, _CBOR_ARRAY, uint64(len(v)))
+		for _, elem := range v {
+			var err error
+			if buf, err = appendCbor(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]any:
+		// keys are sorted by their encoded bytes
+		type entry struct{ key, value []byte }
+		entries := make([]entry, 0, len(v))
+		for key, elem := range v {
+			encodedKey, err := appendCbor(nil, key)
+			if err != nil {
+				return nil, err
+			}
+			encodedValue, err := appendCbor(nil, elem)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{encodedKey, encodedValue})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+
+		buf = appendCborHead(buf, _CBOR_MAP, uint64(len(v)))
+		for _, e := range entries {
+			buf = append(append(buf, e.key...), e.value...)
+		}
+		return buf, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Values of type %T can not be encoded", value))
+	}
+}
+
+func readCborHead(data []byte) (major byte, arg uint64, rest []byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errMalformedCbor
+	}
+
+	major = data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return major, uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	default: // indefinite lengths and reserved values are not supported
+		return 0, 0, nil, errMalformedCbor
+	}
+}
+
+func readCbor(data []byte, depth int) (value any, rest []byte, err error) {
+	if depth > _CBOR_MAX_DEPTH {
+		return nil, nil, errMalformedCbor
+	}
+
+	major, arg, rest, err := readCborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case _CBOR_UINT:
+		return float64(arg), rest, nil
+	case _CBOR_NEGINT:
+		return -1 - float64(arg), rest, nil
+	case _CBOR_BYTES, _CBOR_TEXT:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errMalformedCbor
+		}
+		content := rest[:arg]
+		if major == _CBOR_BYTES {
+			return bytes.Clone(content), rest[arg:], nil
+		}
+		if !utf8.Valid(content) {
+			return nil, nil, errMalformedCbor
+		}
+		return string(content), rest[arg:], nil
+	case _CBOR_ARRAY:
+		if arg > uint64(len(rest)) { // every element takes at least a byte
+			return nil, nil, errMalformedCbor
+		}
+		array := make([]any, arg)
+		for idx := range array {
+			if array[idx], rest, err = readCbor(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return array, rest, nil
+	case _CBOR_MAP:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errMalformedCbor
+		}
+		object := make(map[string]any, arg)
+		for range arg {
+			var key, elem any
+			if key, rest, err = readCbor(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			keyText, ok := key.(string)
+			if _, duplicated := object[keyText]; !ok || duplicated {
+				return nil, nil, errMalformedCbor
+			}
+			if elem, rest, err = readCbor(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			object[keyText] = elem
+		}
+		return object, rest, nil
+	case _CBOR_SIMPLE:
+		switch data[0] & 0x1f {
+		case _CBOR_FALSE:
+			return false, rest, nil
+		case _CBOR_TRUE:
+			return true, rest, nil
+		case _CBOR_NULL:
+			return nil, rest, nil
+		case _CBOR_FLOAT64:
+			if f := math.Float64frombits(arg); !math.IsNaN(f) && !math.IsInf(f, 0) {
+				return f, rest, nil
+			}
+		}
+	}
+
+	return nil, nil, errMalformedCbor
+}
@@ -0,0 +1,115 @@
+package crdts
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+type conformanceVectors struct {
+	Seed  string `json:"seed"`
+	Valid []struct {
+		Name      string          `json:"name"`
+		Operation json.RawMessage `json:"operation"`
+		Content   string          `json:"content"`
+		Signed    string          `json:"signed"`
+		Hash      string          `json:"hash"`
+	} `json:"valid"`
+	Legacy []struct {
+		Name   string `json:"name"`
+		Signed string `json:"signed"`
+	} `json:"legacy"`
+	Invalid []struct {
+		Name   string `json:"name"`
+		Signed string `json:"signed"`
+	} `json:"invalid"`
+}
+
+func readVectorOperation(t *testing.T, raw json.RawMessage) Operation {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var fields struct {
+		Op    string   `json:"op"`
+		Preds []string `json:"preds"`
+		Crdt  any      `json:"crdt"`
+		Type  string   `json:"type"`
+		Nonce string   `json:"nonce"`
+	}
+	if err := decoder.Decode(&fields); err != nil {
+		t.Fatal("Malformed vector operation:", err)
+	}
+
+	return Operation{
+		Op:    fields.Op,
+		Preds: fields.Preds,
+		Crdt:  fields.Crdt,
+		Type:  CRDT_TYPE(fields.Type),
+		Nonce: fields.Nonce,
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal("Malformed vector hex:", err)
+	}
+	return decoded
+}
+
+func TestConformanceVectors(t *testing.T) {
+	file, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors conformanceVectors
+	if err := json.Unmarshal(file, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	secretkey := ed25519.NewKeyFromSeed(decodeHex(t, vectors.Seed))
+
+	for _, vector := range vectors.Valid {
+		op := readVectorOperation(t, vector.Operation)
+
+		content, err := encodeOperation(op)
+		if err != nil || hex.EncodeToString(content) != vector.Content {
+			t.Errorf("%s: encoded as %x (%v), expected %s", vector.Name, content, err, vector.Content)
+			continue
+		}
+
+		signed, err := SignOperation(secretkey, op)
+		if err != nil || hex.EncodeToString(signed) != vector.Signed {
+			t.Errorf("%s: signed as %x (%v), expected %s", vector.Name, signed, err, vector.Signed)
+			continue
+		}
+
+		if hash := HashOperation(signed); hash != vector.Hash {
+			t.Errorf("%s: hashed as %s, expected %s", vector.Name, hash, vector.Hash)
+		}
+
+		read, err := ReadOperation(signed)
+		if err != nil {
+			t.Errorf("%s: could not be read: %v", vector.Name, err)
+			continue
+		}
+		if reencoded, _ := encodeOperation(read); !bytes.Equal(reencoded, content) {
+			t.Errorf("%s: does not encode the same after being read", vector.Name)
+		}
+	}
+
+	for _, vector := range vectors.Legacy {
+		if _, err := ReadOperation(decodeHex(t, vector.Signed)); err != nil {
+			t.Errorf("%s: could not be read: %v", vector.Name, err)
+		}
+	}
+
+	for _, vector := range vectors.Invalid {
+		if _, err := ReadOperation(decodeHex(t, vector.Signed)); err == nil {
+			t.Errorf("%s: was accepted", vector.Name)
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"errors"
 )
 
+var ErrInvalidOperation = errors.New("The operation provided is not valid")
+
 type Operation struct {
 	Op    string
 	Preds []string
@@ -31,6 +33,13 @@ func HashOperation(op SignedOperation) string {
 	return hex.EncodeToString(hash[:])
 }
 
+func OperationAuthor(op SignedOperation) string {
+	if len(op) < 32 {
+		return ""
+	}
+	return hex.EncodeToString(op[:32])
+}
+
 func IsValid(payload []byte) bool {
 	if len(payload) < 96 {
 		return false
@@ -44,10 +53,14 @@ func IsValid(payload []byte) bool {
 
 func ReadOperation(payload []byte) (op Operation, err error) {
 	if !IsValid(payload) {
-		return op, errors.New("The operation provided is not valid")
+		return op, ErrInvalidOperation
 	}
 
 	content := payload[96:]
+	if len(content) > 0 && content[0] == OP_FORMAT_CBOR {
+		return decodeOperation(content)
+	}
+
 	err = json.Unmarshal(content, &op)
 	if err != nil {
 		return op, err
@@ -57,26 +70,28 @@ func ReadOperation(payload []byte) (op Operation, err error) {
 }
 
 func SignOperation(secretkey ed25519.PrivateKey, operation Operation) ([]byte, error) {
-	opjson, err := json.Marshal(operation)
+	content, err := encodeOperation(operation)
 
 	if err != nil {
-		return opjson, err
+		return content, err
 	}
 
 	var publickey ed25519.PublicKey = secretkey.Public().(ed25519.PublicKey)
-	var signature []byte = ed25519.Sign(secretkey, opjson)
+	var signature []byte = ed25519.Sign(secretkey, content)
 
 	var signed_op []byte = make([]byte, 0)
 	signed_op = append(signed_op, publickey...)
 	signed_op = append(signed_op, signature...)
-	return append(signed_op, opjson...), nil
+	return append(signed_op, content...), nil
 }
 
 type graphNode struct {
-	value Operation
-	preds []string
-	succs []string
-	tier  int
+	hash   string
+	author string
+	value  Operation
+	preds  []string
+	succs  []string
+	tier   int
 }
 
 type OpCalcResult struct {
@@ -156,6 +171,8 @@ func CalculateOperations(signedops []SignedOperation, crdtType CRDT_TYPE) OpCalc
 		reducer = &gSetReducer{result: make(map[any]bool)}
 	case CRDT_2PSET:
 		reducer = &twoPhaseSetReducer{result: make(map[any]bool)}
+	case CRDT_ALIAS:
+		reducer = &aliasRegistryReducer{nodes: make(map[string]graphNode)}
 	}
 
 	for k, v := range hashGraph {
@@ -163,6 +180,8 @@ func CalculateOperations(signedops []SignedOperation, crdtType CRDT_TYPE) OpCalc
 			heads = append(heads, signedOperationsMap[k])
 		}
 
+		v.hash = k
+		v.author = OperationAuthor(signedOperationsMap[k])
 		reducer.add(v)
 	}
 
@@ -260,13 +279,8 @@ func (r *twoPhaseSetReducer) value() any {
 	return keys
 }
 
-func CalculateOperationsTopologicalOrder(ops []string) []string {
-	opStringMap := make(map[string]string)
-	signedops := utils.Map(ops, func(elem string) []byte {
-		r, _ := hex.DecodeString(elem)
-		opStringMap[HashOperation(r)] = elem
-		return r
-	})
+func CalculateOperationsTopologicalOrder(signedops []SignedOperation) []SignedOperation {
+	signedOperationsMap := make(map[string]SignedOperation)
 	validOperationsMap := make(map[string]Operation)
 
 	for _, signedop := range signedops {
@@ -274,6 +288,7 @@ func CalculateOperationsTopologicalOrder(ops []string) []string {
 
 		if err == nil {
 			validOperationsMap[HashOperation(signedop)] = readOp
+			signedOperationsMap[HashOperation(signedop)] = signedop
 		}
 	}
 
@@ -308,8 +323,8 @@ func CalculateOperationsTopologicalOrder(ops []string) []string {
 
 	}
 
-	res := utils.Map(opTopologicalSort(hashGraph), func(elem string) string {
-		return opStringMap[elem]
+	res := utils.Map(opTopologicalSort(hashGraph), func(elem string) SignedOperation {
+		return signedOperationsMap[elem]
 	})
 
 	if len(res) != len(keys) {
@@ -338,20 +353,12 @@ func opTopologicalSort(hashGraph map[string]graphNode) []string {
 		queue = queue[1:]
 		list = append(list, u)
 
-		toDel := make([]int, 0)
-		uNode := hashGraph[u]
-		for idx, succ := range uNode.succs {
-			toDel = append(toDel, idx)
-
+		// removing from the succs being iterated would skip some of them
+		for _, succ := range hashGraph[u].succs {
 			succVal := hashGraph[succ]
 			succVal.preds = set.Remove(succVal.preds, u)
 			hashGraph[succ] = succVal
 
-			// NOTE: This might be unnecessary
-			uVal := hashGraph[u]
-			uVal.succs = set.Remove(uVal.succs, succ)
-			hashGraph[u] = uVal
-
 			if len(hashGraph[succ].preds) == 0 {
 				queue = append(queue, succ)
 			}
@@ -1,10 +1,10 @@
 module bftkvstore
 
-require github.com/google/uuid v1.6.0
-
 require (
-	github.com/bits-and-blooms/bitset v1.14.3 // indirect
-	github.com/bits-and-blooms/bloom/v3 v3.7.0 // indirect
+	github.com/bits-and-blooms/bloom/v3 v3.7.0
+	github.com/google/uuid v1.6.0
 )
 
+require github.com/bits-and-blooms/bitset v1.14.3 // indirect
+
 go 1.23.1
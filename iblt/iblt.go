@@ -0,0 +1,181 @@
+package iblt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// An invertible Bloom lookup table of 32 byte hashes. Two tables of the same
+// size subtracted from each other hold the symmetric difference of their sets,
+// which can be listed as long as it is small compared to the size of the
+// tables. Each hash goes to one cell of each of the HASHES partitions of the
+// table.
+const (
+	HASHES   = 4
+	KEY_SIZE = 32
+
+	_CELL_SIZE = 4 + KEY_SIZE + 8
+)
+
+var ErrSizeMismatch = errors.New("The tables do not have the same number of cells")
+var ErrMalformed = errors.New("Malformed table")
+
+type Key [KEY_SIZE]byte
+
+type cell struct {
+	count   int32
+	keySum  Key
+	hashSum uint64
+}
+
+type Table struct {
+	cells []cell
+}
+
+// Creates a table of at least the given number of cells, rounded up to a
+// multiple of HASHES
+func New(cells int) *Table {
+	cells = max(cells, HASHES)
+	cells += (HASHES - cells%HASHES) % HASHES
+	return &Table{cells: make([]cell, cells)}
+}
+
+func (t *Table) Cells() int {
+	return len(t.cells)
+}
+
+func (t *Table) Insert(key Key) {
+	t.update(key, 1)
+}
+
+func (t *Table) Remove(key Key) {
+	t.update(key, -1)
+}
+
+func (t *Table) update(key Key, count int32) {
+	check := checksum(key)
+	for _, idx := range t.positions(key) {
+		c := &t.cells[idx]
+		c.count += count
+		c.hashSum ^= check
+		for i := range c.keySum {
+			c.keySum[i] ^= key[i]
+		}
+	}
+}
+
+// Returns the table of the keys only in t (counted once) and the keys only in
+// o (counted minus once)
+func (t *Table) Subtract(o *Table) (*Table, error) {
+	if len(t.cells) != len(o.cells) {
+		return nil, ErrSizeMismatch
+	}
+
+	diff := &Table{cells: make([]cell, len(t.cells))}
+	for idx := range t.cells {
+		diff.cells[idx].count = t.cells[idx].count - o.cells[idx].count
+		diff.cells[idx].hashSum = t.cells[idx].hashSum ^ o.cells[idx].hashSum
+		for i := range diff.cells[idx].keySum {
+			diff.cells[idx].keySum[i] = t.cells[idx].keySum[i] ^ o.cells[idx].keySum[i]
+		}
+	}
+	return diff, nil
+}
+
+// Lists the keys inserted and removed, ok is false when the table holds too
+// many of them to list them all. The table is emptied in the process. A table
+// can not hold more keys than cells, so tables crafted to never empty are
+// given up on after that many keys.
+func (t *Table) Decode() (inserted []Key, removed []Key, ok bool) {
+	inserted = make([]Key, 0)
+	removed = make([]Key, 0)
+
+	pure := make([]int, 0)
+	for idx := range t.cells {
+		if t.isPure(idx) {
+			pure = append(pure, idx)
+		}
+	}
+
+	for len(pure) > 0 && len(inserted)+len(removed) < len(t.cells) {
+		idx := pure[len(pure)-1]
+		pure = pure[:len(pure)-1]
+		if !t.isPure(idx) {
+			continue
+		}
+
+		key := t.cells[idx].keySum
+		count := t.cells[idx].count
+		if count == 1 {
+			inserted = append(inserted, key)
+		} else {
+			removed = append(removed, key)
+		}
+
+		t.update(key, -count)
+		for _, other := range t.positions(key) {
+			if t.isPure(other) {
+				pure = append(pure, other)
+			}
+		}
+	}
+
+	for _, c := range t.cells {
+		if c.count != 0 || c.hashSum != 0 || c.keySum != (Key{}) {
+			return inserted, removed, false
+		}
+	}
+	return inserted, removed, true
+}
+
+// A cell holds a single key when its checksum matches and it is one of the
+// cells of that key
+func (t *Table) isPure(idx int) bool {
+	c := t.cells[idx]
+	positions := t.positions(c.keySum)
+	return (c.count == 1 || c.count == -1) && c.hashSum == checksum(c.keySum) && slices.Contains(positions[:], idx)
+}
+
+func (t *Table) positions(key Key) [HASHES]int {
+	var positions [HASHES]int
+	partition := len(t.cells) / HASHES
+	for i := range HASHES {
+		hash := sha256.Sum256(append([]byte{byte(i)}, key[:]...))
+		positions[i] = i*partition + int(binary.BigEndian.Uint64(hash[:8])%uint64(partition))
+	}
+	return positions
+}
+
+func checksum(key Key) uint64 {
+	hash := sha256.Sum256(append([]byte{HASHES}, key[:]...))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// Encodes the table as, for each cell, the count (4 bytes), the XOR of the
+// keys and the XOR of their checksums (8 bytes)
+func (t *Table) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, len(t.cells)*_CELL_SIZE)
+	for _, c := range t.cells {
+		data = binary.BigEndian.AppendUint32(data, uint32(c.count))
+		data = append(data, c.keySum[:]...)
+		data = binary.BigEndian.AppendUint64(data, c.hashSum)
+	}
+	return data, nil
+}
+
+func (t *Table) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || len(data)%(_CELL_SIZE*HASHES) != 0 {
+		return ErrMalformed
+	}
+
+	t.cells = make([]cell, len(data)/_CELL_SIZE)
+	for idx := range t.cells {
+		encoded := data[idx*_CELL_SIZE : (idx+1)*_CELL_SIZE]
+		t.cells[idx].count = int32(binary.BigEndian.Uint32(encoded[:4]))
+		copy(t.cells[idx].keySum[:], encoded[4:4+KEY_SIZE])
+		t.cells[idx].hashSum = binary.BigEndian.Uint64(encoded[4+KEY_SIZE:])
+	}
+	return nil
+}
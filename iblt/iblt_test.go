@@ -0,0 +1,125 @@
+package iblt_test
+
+import (
+	"bftkvstore/iblt"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func keyOf(n int) iblt.Key {
+	return sha256.Sum256([]byte(fmt.Sprint(n)))
+}
+
+func TestDecodeDifference(t *testing.T) {
+	tableA := iblt.New(64)
+	tableB := iblt.New(64)
+	for n := range 1000 {
+		tableA.Insert(keyOf(n))
+		tableB.Insert(keyOf(n))
+	}
+	onlyA := []iblt.Key{keyOf(1000), keyOf(1001), keyOf(1002)}
+	onlyB := []iblt.Key{keyOf(2000), keyOf(2001)}
+	for _, key := range onlyA {
+		tableA.Insert(key)
+	}
+	for _, key := range onlyB {
+		tableB.Insert(key)
+	}
+
+	diff, err := tableA.Subtract(tableB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted, removed, ok := diff.Decode()
+	if !ok {
+		t.Fatal("Failed to decode a difference of", len(onlyA)+len(onlyB), "keys in", diff.Cells(), "cells")
+	}
+
+	for _, key := range onlyA {
+		if !slices.Contains(inserted, key) {
+			t.Error("Missing key only in A", key)
+		}
+	}
+	for _, key := range onlyB {
+		if !slices.Contains(removed, key) {
+			t.Error("Missing key only in B", key)
+		}
+	}
+	if len(inserted) != len(onlyA) || len(removed) != len(onlyB) {
+		t.Error("Decoded", len(inserted), "and", len(removed), "keys instead of", len(onlyA), "and", len(onlyB))
+	}
+}
+
+func TestDecodeTooLargeDifference(t *testing.T) {
+	table := iblt.New(8)
+	for n := range 100 {
+		table.Insert(keyOf(n))
+	}
+
+	if _, _, ok := table.Decode(); ok {
+		t.Error("Decoding 100 keys in", table.Cells(), "cells should fail")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	table := iblt.New(32)
+	table.Insert(keyOf(1))
+
+	data, err := table.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded iblt.Table
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	inserted, _, ok := decoded.Decode()
+	if !ok || len(inserted) != 1 || inserted[0] != keyOf(1) {
+		t.Error("The decoded table should hold the key", keyOf(1), "but holds", inserted)
+	}
+}
+
+// A table with a single cell claiming to remove a key, which would never empty
+// as removing the key from its cells makes the others pure in turn
+func TestDecodeCraftedTable(t *testing.T) {
+	for _, cells := range []int{4, 8} {
+		key := keyOf(1)
+		check := sha256.Sum256(append([]byte{iblt.HASHES}, key[:]...))
+
+		data := make([]byte, 0)
+		for idx := range cells {
+			cell := make([]byte, 4+iblt.KEY_SIZE+8)
+			if idx == 0 {
+				binary.BigEndian.PutUint32(cell, uint32(0xFFFFFFFF))
+				copy(cell[4:], key[:])
+				copy(cell[4+iblt.KEY_SIZE:], check[:8])
+			}
+			data = append(data, cell...)
+		}
+
+		var table iblt.Table
+		if err := table.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := make(chan bool)
+		go func() {
+			_, _, ok := table.Decode()
+			decoded <- ok
+		}()
+
+		select {
+		case ok := <-decoded:
+			if ok {
+				t.Error("Decoding the crafted table of", cells, "cells should fail")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Decoding the crafted table of", cells, "cells did not end")
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin commands make the node act on behalf of whoever sends them, so they
+// are only taken on the admin socket, which only the user running the node can
+// open, or when signed by one of the operators of the configuration. The
+// operator signs
+//
+//	bftkvstore admin\n<node public key>\n<header>\n<argument>\n...<unix timestamp>
+//
+// with the hex encoded key of the node the command is for, so it can not be
+// replayed to another node, and the signature is accepted once, within a
+// minute of the timestamp.
+const (
+	ADMIN_SOCKET = "admin.sock"
+
+	_ADMIN_SIGNATURE_WINDOW = time.Minute
+)
+
+var errNotOperator = errors.New("Admin commands must be sent on the admin socket or signed by an operator")
+
+type operatorSignatureDTO struct {
+	Operator  string `json:"operator,omitempty"`  // hex encoded public key
+	Timestamp int64  `json:"timestamp,omitempty"` // unix seconds
+	Signature string `json:"signature,omitempty"` // hex encoded
+}
+
+var lockSeenSignatures sync.Mutex
+var seenSignatures = make(map[string]time.Time) // signature -> expiry
+
+func adminCommandBytes(nodeKey string, header MessageHeader, timestamp int64, args ...string) []byte {
+	lines := append([]string{"bftkvstore admin", nodeKey, string(header)}, args...)
+	lines = append(lines, fmt.Sprint(timestamp))
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func checkOperator(ctx *context.AppContext, header MessageHeader, signed operatorSignatureDTO, args ...string) error {
+	if signed.Signature == "" || !ctx.Operators[signed.Operator] {
+		return errNotOperator
+	}
+
+	signedAt := time.Unix(signed.Timestamp, 0)
+	if time.Since(signedAt).Abs() > _ADMIN_SIGNATURE_WINDOW {
+		return errors.New("The signature of the admin command expired")
+	}
+
+	key, keyErr := hex.DecodeString(signed.Operator)
+	sig, sigErr := hex.DecodeString(signed.Signature)
+	if keyErr != nil || sigErr != nil || !ed25519.Verify(key, adminCommandBytes(ownPublicKey(ctx), header, signed.Timestamp, args...), sig) {
+		return errors.New("The signature of the admin command is not valid")
+	}
+
+	lockSeenSignatures.Lock()
+	defer lockSeenSignatures.Unlock()
+
+	now := time.Now()
+	for seen, expiry := range seenSignatures {
+		if now.After(expiry) {
+			delete(seenSignatures, seen)
+		}
+	}
+	if _, seen := seenSignatures[signed.Signature]; seen {
+		return errors.New("The admin command was already sent")
+	}
+	seenSignatures[signed.Signature] = signedAt.Add(_ADMIN_SIGNATURE_WINDOW)
+
+	return nil
+}
@@ -5,37 +5,43 @@ import (
 	"bftkvstore/crdts"
 	"bftkvstore/logger"
 	"bftkvstore/set"
+	"bftkvstore/storage"
 	"bftkvstore/utils"
+	stdcontext "context"
+	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
 	"net"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
-	// "github.com/bits-and-blooms/bloom/v3"
 )
 
 const _HEADS_ROUTINE_SECONDS = 30
 
 type connectionVariables struct {
-	sent    set.Set[string]
-	recvd   set.Set[string]
-	missing set.Set[string]
-	mconn   set.Set[string]
-	// oldHeads set.Set[string]
+	sent     set.Set[string]
+	recvd    set.Set[string]
+	missing  set.Set[string]
+	mconn    set.Set[string]
+	sketched set.Set[string] // keys sketched during this round
 }
 
+// Each peer is served by its own goroutine, which owns the connection
+// variables, while a reader goroutine hands it the frames of the connection
 type connectionData struct {
-	lHeadsMsg time.Time
-	conn      net.Conn
-	vars      *connectionVariables
-	ch        chan []byte
-	hangup    chan bool
+	id   string // the key of the peer, or its address when it did not prove one
+	name string
+	node context.Node
+	conn *Conn
+	vars *connectionVariables
+	msgs chan []byte // closed once the connection fails
 }
 
-var connections map[string]*connectionData = make(map[string]*connectionData)
+var lockConnections sync.Mutex
+var connections map[string]*connectionData = make(map[string]*connectionData) // by id
 
 var lockM sync.Mutex
 var M set.Set[string] = set.New[string]()
@@ -53,121 +59,243 @@ func isNetConnClosedErr(err error) bool {
 }
 
 func listenToConnection(connData *connectionData) {
+	defer close(connData.msgs)
+
 	for {
-		msg, err := ReadFromConnection(connData.conn)
+		msg, _, err := ReadFromConnection(connData.conn)
 
 		if err != nil {
 			if isNetConnClosedErr(err) {
-				logger.Alert("Connection Closed")
-				connData.hangup <- true
-				return
+				logger.Alert("Connection Closed", connData.name)
 			} else {
-				logger.Error("Error in listen", err)
-				connData.hangup <- true
-				return
+				logger.Error("Error in listen", connData.name, err)
 			}
+			return
 		}
 
-		connData.ch <- msg
+		connData.msgs <- msg
 	}
 }
 
-func BroadcastReceiver(ctx *context.AppContext) {
+// Serves the nodes added to the context until runCtx is done, then says
+// goodbye to them and returns once every peer is torn down
+func BroadcastReceiver(runCtx stdcontext.Context, ctx *context.AppContext) {
+	var peers sync.WaitGroup
+	defer peers.Wait()
+
 	for {
-		// check for new nodes
-		if len(ctx.NewNodes) > 0 && ctx.Lock.TryLock() {
-			if len(ctx.NewNodes) > 0 {
-				node := ctx.NewNodes[0]
-
-				name := fmt.Sprintf("%s:%s", node.Address, node.Port)
-
-				val, exists := connections[name]
-
-				if exists {
-					val.conn = node.Conn
-					val.ch = make(chan []byte)
-					val.hangup = make(chan bool)
-					connections[name] = val
-				} else {
-					connections[name] = &connectionData{
-						lHeadsMsg: time.Now(),
-						conn:      node.Conn,
-						vars:      nil,
-						ch:        make(chan []byte),
-						hangup:    make(chan bool),
-					}
-				}
-				go listenToConnection(connections[name])
-
-				if !exists {
-					onConnectionToAnotherReplica(ctx, connections[name])
-				}
-
-				ctx.NewNodes = ctx.NewNodes[1:]
-			}
-			ctx.Lock.Unlock()
+		var node context.Node
+		select {
+		case node = <-ctx.NewNodes:
+		case <-runCtx.Done():
+			return
 		}
-		for name, connData := range connections {
-			select {
-			case payload := <-connData.ch:
-				if len(payload) < 4 {
-					continue
-				}
-
-				header := MessageHeader(payload[:4])
-
-				switch header {
-				case MSGS:
-					onReceivingMsgs(ctx, connData, payload[4:])
-				case NEEDS:
-					onReceivingNeeds(ctx, connData, payload[4:])
-				case HEADS:
-					onReceivingHeads(ctx, connData, payload[4:])
-				}
-			case <-connData.hangup:
+
+		conn, isConn := node.Conn.(*Conn)
+		if !isConn {
+			conn = NewConn(node.Conn)
+		}
+
+		connData := &connectionData{
+			id:   conn.PeerKey(),
+			name: net.JoinHostPort(node.Address, node.Port),
+			node: node,
+			conn: conn,
+			msgs: make(chan []byte),
+		}
+
+		if connData.id == "" {
+			connData.id = connData.name
+		}
+
+		// a new connection to a known peer replaces the old one, which is
+		// torn down by its own goroutine once its reader fails
+		lockConnections.Lock()
+		if old, exists := connections[connData.id]; exists {
+			if keepsOld(ctx, old, connData) {
+				lockConnections.Unlock()
 				connData.conn.Close()
-				delete(connections, name)
-				continue
-			default:
 				continue
 			}
+			old.conn.Close()
 		}
-		// gossip
-		timenow := time.Now()
-		for name, connData := range connections {
-			diff := timenow.Sub(connData.lHeadsMsg).Seconds()
-			if diff > _HEADS_ROUTINE_SECONDS {
-				logger.Debug("Routine send of heads to", name)
-				onConnectionToAnotherReplica(ctx, connData)
+		connections[connData.id] = connData
+		lockConnections.Unlock()
+
+		addMembers(ctx, []memberDTO{{Address: node.Address, Port: node.Port, PublicKey: conn.PeerKey()}}, true)
+
+		peers.Add(1)
+		go listenToConnection(connData)
+		go func() {
+			defer peers.Done()
+			servePeer(runCtx, ctx, connData)
+
+			// only the side that dialed redials, otherwise both connections
+			// would keep replacing each other
+			if removePeer(connData) && connData.node.Redial && runCtx.Err() == nil {
+				go KeepConnected(runCtx, ctx, connData.node.Address, connData.node.Port, connData.node.ExpectedKey)
 			}
+		}()
+	}
+}
+
+func servePeer(runCtx stdcontext.Context, ctx *context.AppContext, connData *connectionData) {
+	onConnectionToAnotherReplica(ctx, connData)
+	sharePeers(ctx, connData)
+
+	gossip := time.NewTicker(_HEADS_ROUTINE_SECONDS * time.Second)
+	defer gossip.Stop()
+
+	for {
+		select {
+		case payload, open := <-connData.msgs:
+			if !open {
+				return
+			}
+			if len(payload) < 4 {
+				continue
+			}
+
+			header := MessageHeader(payload[:4])
+
+			switch header {
+			case MSGS:
+				onReceivingMsgs(ctx, connData, payload[4:])
+			case NEEDS:
+				onReceivingNeeds(ctx, connData, payload[4:])
+			case HEADS:
+				onReceivingHeads(ctx, connData, payload[4:])
+			case DIGEST:
+				onReceivingDigest(ctx, connData, payload[4:])
+			case SKETCH:
+				onReceivingSketch(ctx, connData, payload[4:])
+			case Q_SNAPSHOT:
+				onReceivingSnapshotRequest(ctx, connData, payload[4:])
+			case SNAPSHOT:
+				onReceivingSnapshot(ctx, connData, payload[4:])
+			case PEERS:
+				onReceivingPeers(ctx, connData, payload[4:])
+			case GOODBYE:
+				logger.Info("Peer", connData.name, "is shutting down")
+				return
+			}
+		case <-runCtx.Done():
+			if err := NewMessage(GOODBYE).Send(connData.conn); err != nil {
+				logger.Alert("Failed to say goodbye to", connData.name, err)
+			}
+			return
+		case <-gossip.C:
+			logger.Debug("Routine send of heads to", connData.name)
+			onConnectionToAnotherReplica(ctx, connData)
+			sharePeers(ctx, connData)
 		}
 	}
 }
 
+// Two nodes dialing each other at the same time end up with two connections,
+// both keep the one dialed by the node with the smaller key. Otherwise the
+// newest connection wins.
+func keepsOld(ctx *context.AppContext, old *connectionData, new *connectionData) bool {
+	peerKey := new.conn.PeerKey()
+	if peerKey == "" || old.node.Dialed == new.node.Dialed {
+		return false
+	}
+
+	ownKey := hex.EncodeToString(ctx.Secretkey.Public().(ed25519.PublicKey))
+	dialerOf := func(connData *connectionData) string {
+		if connData.node.Dialed {
+			return ownKey
+		}
+		return peerKey
+	}
+
+	return dialerOf(old) < dialerOf(new)
+}
+
+// Tears down the connection, returns false if it had been replaced already
+func removePeer(connData *connectionData) (removed bool) {
+	connData.conn.Close()
+
+	lockConnections.Lock()
+	if connections[connData.id] == connData {
+		delete(connections, connData.id)
+		removed = true
+	}
+	lockConnections.Unlock()
+
+	// let the reader finish if it is still handing over a frame
+	for range connData.msgs {
+	}
+
+	return removed
+}
+
 type msgsDTO struct {
-	Key      string   `json:"key"`
-	Messages []string `json:"messages"`
+	Key      string    `json:"key"`
+	Messages []string  `json:"messages"`
+	Batch    []msgsDTO `json:"batch,omitempty"` // operations of several keys to be applied together
 }
 
 func broadcast(ctx *context.AppContext, key string, m crdts.SignedOperation) {
 	lockM.Lock()
-	M = set.Add(M, hex.EncodeToString(m))
+	M = set.Add(M, string(m))
 	lockM.Unlock()
 
-	msg := NewMessage(MSGS).AddContent(msgsDTO{
+	sendToAll(msgsDTO{
 		Key:      key,
-		Messages: []string{hex.EncodeToString(m)},
+		Messages: []string{string(m)},
+	})
+}
+
+func broadcastBatch(ctx *context.AppContext, entries []storage.BatchEntry) {
+	batch := make([]msgsDTO, 0)
+	groups := make(map[string]int)
+
+	lockM.Lock()
+	for _, entry := range entries {
+		opStr := string(entry.Op)
+		M = set.Add(M, opStr)
+
+		idx, exists := groups[entry.Key]
+		if !exists {
+			idx = len(batch)
+			groups[entry.Key] = idx
+			batch = append(batch, msgsDTO{Key: entry.Key, Messages: make([]string, 0)})
+		}
+		batch[idx].Messages = append(batch[idx].Messages, opStr)
+	}
+	lockM.Unlock()
+
+	sendToAll(msgsDTO{
+		Messages: make([]string, 0),
+		Batch:    batch,
 	})
-	if msg.IsMalformed() { // should never happen
+}
+
+func sendToAll(data msgsDTO) {
+	// each peer gets the operations in the encoding it negotiated
+	msgs := map[bool]Message{
+		false: newMsgsMessage(data, false),
+		true:  newMsgsMessage(data, true),
+	}
+	if msgs[false].IsMalformed() { // should never happen
 		logger.Fatal("Broadcast message is malformed")
 		return
 	}
 
+	// writes may block, so they do not hold the lock
+	lockConnections.Lock()
+	targets := make([]*connectionData, 0, len(connections))
 	for _, connData := range connections {
-		if connData.conn != nil {
-			if err := msg.Send(connData.conn); err != nil {
-				logger.Alert("Failed to send Message during broadcast", err)
-			}
+		targets = append(targets, connData)
+	}
+	lockConnections.Unlock()
+
+	for _, connData := range targets {
+		if err := msgs[connData.conn.RawOps()].Send(connData.conn); err != nil {
+			// a frame may be cut short, so the connection can not be used anymore
+			logger.Alert("Failed to send Message during broadcast to", connData.name, err)
+			connData.conn.Close()
 		}
 	}
 }
@@ -176,110 +304,37 @@ func onConnectionToAnotherReplica(ctx *context.AppContext, connData *connectionD
 	// connection-local variables
 	lockM.Lock()
 	connData.vars = &connectionVariables{
-		sent:    set.New[string](),
-		recvd:   set.New[string](),
-		missing: set.New[string](),
-		mconn:   M,
-		// oldHeads: set.New[string](),
+		sent:     set.New[string](),
+		recvd:    set.New[string](),
+		missing:  set.New[string](),
+		mconn:    slices.Clone(M),
+		sketched: set.New[string](),
 	}
 	lockM.Unlock()
 
+	// a node downloading a snapshot gets the operations from it
+	if requestSnapshot(ctx, connData) || downloadingSnapshot() {
+		return
+	}
+
+	if connData.conn.Digests() {
+		sendDigest(ctx, connData, "")
+		return
+	}
+
 	heads := ctx.Storage.GetHeads()
 
 	for key, hds := range heads {
-		NewMessage(HEADS).AddContent(msgsDTO{
-			Key:      key,
-			Messages: utils.Map(hds, crdts.HashOperation),
-		}).Send(connData.conn)
+		newHeadsMessage(ctx, connData, key, utils.Map(hds, crdts.HashOperation)).Send(connData.conn)
 	}
-
-	connData.lHeadsMsg = time.Now()
 }
 
-/*
-	func onConnectionToAnotherReplicaAlg2(ctx *context.AppContext, connData *connectionData) {
-		oldHeads := set.New[string]()
-		if connData.vars != nil {
-			oldHeads = connData.vars.oldHeads
-		}
-		// connection-local variables
-		connData.vars = &connectionVariables{
-			sent:     set.New[string](),
-			recvd:    set.New[string](),
-			missing:  set.New[string](),
-			oldHeads: oldHeads,
-			mconn:    M,
-		}
-
-		// NOTE: I don't know what these parameters are, only that the first is the number of bytes
-		bloomFilter := bloom.New(1000, 4)
-		for _, head := range oldHeads {
-			headBytes, _ := hex.DecodeString(head)
-			bloomFilter.Add(headBytes)
-		}
-
-		// replace with get heads from Mconn
-		heads := utils.Map(ctx.Storage.GetHeads(), hex.EncodeToString)
-		filter := bloomFilter.BitSet().Bytes()
-
-		// send ⟨heads : heads(Mconn), oldHeads : oldHeads, filter : filter
-
-		for key, hds := range heads {
-			NewMessage(HEADS).AddContent(struct {
-				Heads    []string
-				OldHeads []string
-				Filter   []uint64
-			}{
-				Heads: heads,
-				Messages: utils.Map(hds, func(el crdts.SignedOperation) string {
-					return crdts.HashOperation(el)
-				}),
-			}).Send(connData.conn)
-		}
+func onReceivingHeads(ctx *context.AppContext, connData *connectionData, body []byte) {
+	if downloadingSnapshot() {
+		return
 	}
 
-	func messagesSince(connData *connectionData, oldHeads []string) set.Set[string] {
-		oldHeadsHashes := set.FromSlice(utils.Map(oldHeads, crdts.HashOperationFromString))
-		known := utils.Filter(connData.vars.mconn, func(elem string) bool {
-			return set.Has(oldHeadsHashes, crdts.HashOperationFromString(elem))
-		})
-
-		mConnHashMap := make(map[string]string)
-
-		utils.Map(connData.vars.mconn, func(elem string) bool {
-			mConnHashMap[crdts.HashOperationFromString(elem)] = elem
-			return true
-		})
-
-		predsOfKnown := set.New[string]()
-		predsOfKnownQueue := known
-
-		for len(predsOfKnownQueue) > 0 {
-			predToCheck := predsOfKnown[0]
-			predsOfKnown = predsOfKnown[1:]
-
-			opBytes, _ := hex.DecodeString(predToCheck)
-			op, err := crdts.ReadOperation(opBytes)
-			if err != nil {
-				continue
-			}
-
-			for _, predHash := range op.Preds {
-				val, exists := mConnHashMap[predHash]
-
-				if exists {
-					predsOfKnownQueue = append(predsOfKnownQueue, val)
-				}
-			}
-
-			set.Add(predsOfKnown, predToCheck)
-		}
-
-		return set.Diff(connData.vars.mconn, predsOfKnown)
-	}
-*/
-func onReceivingHeads(ctx *context.AppContext, connData *connectionData, body []byte) {
-	data, err := unmarshallJson[msgsDTO](body)
+	data, err := unmarshallJson[headsDTO](body)
 	if err != nil {
 		logger.Error("Failed to parse heads JSON", err, string(body))
 		return
@@ -288,37 +343,103 @@ func onReceivingHeads(ctx *context.AppContext, connData *connectionData, body []
 	key := data.Key
 	hs := set.FromSlice(data.Messages)
 
-	mConnHashes := utils.Map(connData.vars.mconn, crdts.HashOperationFromString)
+	if data.Filter != nil {
+		pushLikelyMissing(ctx, connData, data)
+	}
+
+	mConnHashes := utils.Map(connData.vars.mconn, hashOf)
 	missing := set.Diff(hs, mConnHashes)
+	if len(missing) == 0 {
+		setOldHeads(connData, key, data.Messages)
+	}
 
 	handleMissing(ctx, connData, key, missing)
 }
 
 func onReceivingMsgs(ctx *context.AppContext, connData *connectionData, body []byte) {
-	data, err := unmarshallJson[msgsDTO](body)
+	data, err := readMsgs(body, connData.conn.RawOps())
 	if err != nil {
-		logger.Error("Failed to parse msgs JSON", err)
+		logger.Error("Failed to parse msgs", err)
 		return
 	}
 
-	signedOps := make([]crdts.Operation, 0)
-	for _, msg := range data.Messages {
-		msgBytes, err := hex.DecodeString(msg)
-		if err != nil {
-			logger.Alert("Failed decode the msgs operation", err)
-			continue
+	if len(data.Batch) > 0 {
+		onReceivingBatch(ctx, connData, data.Batch)
+		return
+	}
+
+	_, signedOps := readReceivedMsgs(connData, data.Messages)
+
+	handleMissing(ctx, connData, data.Key, unresolvedPreds(connData, signedOps))
+}
+
+// A batch is applied atomically when every predecessor is already known,
+// otherwise its keys are reconciled one by one like regular messages
+func onReceivingBatch(ctx *context.AppContext, connData *connectionData, batch []msgsDTO) {
+	unresolved := make(map[string]set.Set[string])
+	received := make(map[string][]string)
+	complete := true
+
+	for _, group := range batch {
+		var signedOps []crdts.Operation
+		received[group.Key], signedOps = readReceivedMsgs(connData, group.Messages)
+		unresolved[group.Key] = unresolvedPreds(connData, signedOps)
+		complete = complete && len(unresolved[group.Key]) == 0
+	}
+
+	if complete {
+		lockM.Lock()
+
+		entries := make([]storage.BatchEntry, 0)
+		applied := set.New[string]()
+		for _, group := range batch {
+			msgs := set.Diff(set.FromSlice(received[group.Key]), M)
+
+			for _, signedOp := range crdts.CalculateOperationsTopologicalOrder(toSignedOperations(msgs)) {
+				entries = append(entries, storage.BatchEntry{Key: group.Key, Op: signedOp})
+				applied = set.Add(applied, string(signedOp))
+			}
+		}
+
+		err := ctx.Storage.AppendBatch(entries)
+		if err == nil {
+			M = set.Union(M, applied)
+		}
+
+		lockM.Unlock()
+
+		if err == nil {
+			connData.vars.mconn = set.Union(connData.vars.mconn, applied)
+			return
 		}
+		logger.Error("Could not apply batch, reconciling its keys separately:", err)
+	}
+
+	for _, group := range batch {
+		handleMissing(ctx, connData, group.Key, unresolved[group.Key])
+	}
+}
 
+// Verifies the received operations and adds the valid ones to recvd
+func readReceivedMsgs(connData *connectionData, messages []string) (valid []string, signedOps []crdts.Operation) {
+	valid = make([]string, 0)
+	signedOps = make([]crdts.Operation, 0)
+	for _, msg := range messages {
 		// ReadOperation checks if it is valid
-		signedOp, err := crdts.ReadOperation(msgBytes)
+		signedOp, err := crdts.ReadOperation(crdts.SignedOperation(msg))
 		if err != nil {
 			logger.Alert("Failed read the msgs operation", err)
 			continue
 		}
+		valid = append(valid, msg)
 		signedOps = append(signedOps, signedOp)
 		connData.vars.recvd = set.Add(connData.vars.recvd, msg)
 	}
 
+	return valid, signedOps
+}
+
+func unresolvedPreds(connData *connectionData, signedOps []crdts.Operation) set.Set[string] {
 	predsToCheck := set.New[string]()
 	for _, signedOp := range signedOps {
 		for _, pred := range signedOp.Preds {
@@ -327,11 +448,9 @@ func onReceivingMsgs(ctx *context.AppContext, connData *connectionData, body []b
 	}
 
 	toHash := set.Union(connData.vars.mconn, connData.vars.recvd)
-	hashes := utils.Map(toHash, crdts.HashOperationFromString)
+	hashes := utils.Map(toHash, hashOf)
 
-	unresolved := set.Diff(predsToCheck, hashes)
-
-	handleMissing(ctx, connData, data.Key, unresolved)
+	return set.Diff(predsToCheck, hashes)
 }
 
 func onReceivingNeeds(ctx *context.AppContext, connData *connectionData, body []byte) {
@@ -344,7 +463,7 @@ func onReceivingNeeds(ctx *context.AppContext, connData *connectionData, body []
 	needs := set.FromSlice(data.Messages)
 
 	reply := utils.Filter(set.Diff(connData.vars.mconn, connData.vars.sent), func(el string) bool {
-		if set.Has(needs, crdts.HashOperationFromString(el)) {
+		if set.Has(needs, hashOf(el)) {
 			return true
 		} else {
 			return false
@@ -354,45 +473,49 @@ func onReceivingNeeds(ctx *context.AppContext, connData *connectionData, body []
 	connData.vars.sent = set.Union(connData.vars.sent, reply)
 
 	if len(reply) != 0 { // otherwise it gets stuck in a loop
-		NewMessage(MSGS).AddContent(
-			msgsDTO{
-				Key:      key,
-				Messages: reply,
-			}).Send(connData.conn)
+		newMsgsMessage(msgsDTO{
+			Key:      key,
+			Messages: reply,
+		}, connData.conn.RawOps()).Send(connData.conn)
 	}
 }
 
 func handleMissing(ctx *context.AppContext, connData *connectionData, key string, hashes set.Set[string]) {
 	connData.vars.missing = set.Diff(
 		set.Union(set.FromSlice(connData.vars.missing), set.FromSlice(hashes)),
-		set.FromSlice(utils.Map(connData.vars.recvd, crdts.HashOperationFromString)),
+		set.FromSlice(utils.Map(connData.vars.recvd, hashOf)),
 	)
 
 	if len(connData.vars.missing) == 0 {
 		lockM.Lock()
+		defer lockM.Unlock()
 
 		msgs := set.Diff(set.FromSlice(connData.vars.recvd), M)
-		M = set.Union(M, connData.vars.recvd)
-
-		lockM.Unlock()
 		connData.vars.mconn = set.Union(connData.vars.mconn, connData.vars.recvd)
 
-		var orderedMsgs []string = crdts.CalculateOperationsTopologicalOrder(msgs)
+		var orderedMsgs []crdts.SignedOperation = crdts.CalculateOperationsTopologicalOrder(toSignedOperations(msgs))
 
-		for _, msg := range orderedMsgs {
-			signedOp, _ := hex.DecodeString(msg)
+		// recvd may hold operations of several keys, each goes to its own
+		keysOf := make(map[string]string)
+		for _, signedOp := range orderedMsgs {
 			op, _ := crdts.ReadOperation(signedOp)
+			opKey := operationKey(ctx, signedOp, op, keysOf, key)
 			var err error
 			if op.Op == "new" {
-				err = ctx.Storage.Assign(key, signedOp)
+				err = ctx.Storage.Assign(opKey, signedOp)
 			} else {
-				err = ctx.Storage.Append(key, signedOp)
+				err = ctx.Storage.Append(opKey, signedOp)
 			}
 
 			if err != nil {
-				logger.Error("Could not append operation", op, "with key", key, "reason:", err)
+				logger.Error("Could not append operation", op, "with key", opKey, "reason:", err)
+			} else {
+				keysOf[crdts.HashOperation(signedOp)] = opKey
+				M = set.Add(M, string(signedOp))
 			}
 		}
+	} else if len(hashes) > 0 && connData.conn.Sketches() && !set.Has(connData.vars.sketched, key) {
+		sendSketch(ctx, connData, key, _SKETCH_MIN_CELLS)
 	} else {
 		NewMessage(NEEDS).AddContent(
 			msgsDTO{
@@ -401,3 +524,31 @@ func handleMissing(ctx *context.AppContext, connData *connectionData, key string
 			}).Send(connData.conn)
 	}
 }
+
+// The key of a "new" operation is its hash, other operations belong to the
+// key of their predecessors
+func operationKey(ctx *context.AppContext, signedOp crdts.SignedOperation, op crdts.Operation, keysOf map[string]string, fallback string) string {
+	if op.Op == "new" {
+		return crdts.HashOperation(signedOp)
+	}
+	if op.Type == crdts.CRDT_ALIAS {
+		return crdts.ALIAS_REGISTRY_KEY
+	}
+
+	for _, pred := range op.Preds {
+		if key, exists := keysOf[pred]; exists {
+			return key
+		}
+		if key, exists := ctx.Storage.KeyOf(pred); exists {
+			return key
+		}
+	}
+
+	return fallback
+}
+
+func toSignedOperations(ops []string) []crdts.SignedOperation {
+	return utils.Map(ops, func(op string) crdts.SignedOperation {
+		return crdts.SignedOperation(op)
+	})
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+type FrameVersion byte
+
+const (
+	FRAME_V1 FrameVersion = 1 // header, 16 bit length and content
+	FRAME_V2 FrameVersion = 2 // marker byte, header, 32 bit length and content
+
+	// frames in the second version start with this byte, headers are ASCII
+	// so a legacy frame never does
+	_FRAME_V2_MARKER byte = 0x02
+
+	MAX_FRAME_VERSION    FrameVersion = FRAME_V2
+	MAX_MESSAGE_SIZE                  = 16 * 1024 * 1024
+	_MAX_V1_MESSAGE_SIZE              = 0xFFFF
+
+	READER_SIZE = 4096
+
+	// clients must send each request within this time, peers exchange heads
+	// periodically so a silent peer is considered gone after a few rounds
+	_CLIENT_READ_TIMEOUT = 10 * time.Second
+	_PEER_READ_TIMEOUT   = 3 * _HEADS_ROUTINE_SECONDS * time.Second
+
+	// a peer that stops reading fails the writes to it instead of blocking
+	// them forever
+	_PEER_WRITE_TIMEOUT = 10 * time.Second
+)
+
+// A connection to a node or client along with the framing used to write to it.
+// Connections start with the legacy framing, clients get replies in the
+// framing of their requests and nodes negotiate it during the handshake.
+// The reader is kept for the whole connection so bytes of the next messages
+// that were already buffered are not lost. Nodes also agree on sending
+// operations as raw bytes instead of hex encoded JSON and on comparing heads
+// through digests and operations through sketches, on sending snapshots, and
+// tell their keys.
+// Over TLS the key of the certificate of the other side is kept to check it
+// is the one proven in the handshake.
+type Conn struct {
+	net.Conn
+	framing      FrameVersion
+	rawOps       bool
+	digests      bool
+	sketches     bool
+	snapshots    bool
+	peerKey      string // hex encoded, empty for clients and older nodes
+	tlsKey       string // hex encoded, empty without TLS or certificate
+	reader       *bufio.Reader
+	readTimeout  time.Duration // zero means no timeout
+	writeTimeout time.Duration // zero means no timeout
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:    conn,
+		framing: FRAME_V1,
+		reader:  bufio.NewReaderSize(conn, READER_SIZE),
+	}
+}
+
+func (conn *Conn) Framing() FrameVersion {
+	return conn.framing
+}
+
+func (conn *Conn) SetFraming(framing FrameVersion) {
+	conn.framing = min(framing, MAX_FRAME_VERSION)
+}
+
+func (conn *Conn) RawOps() bool {
+	return conn.rawOps
+}
+
+func (conn *Conn) SetRawOps(rawOps bool) {
+	conn.rawOps = rawOps
+}
+
+func (conn *Conn) Digests() bool {
+	return conn.digests
+}
+
+func (conn *Conn) SetDigests(digests bool) {
+	conn.digests = digests
+}
+
+func (conn *Conn) Sketches() bool {
+	return conn.sketches
+}
+
+func (conn *Conn) SetSketches(sketches bool) {
+	conn.sketches = sketches
+}
+
+func (conn *Conn) Snapshots() bool {
+	return conn.snapshots
+}
+
+func (conn *Conn) SetSnapshots(snapshots bool) {
+	conn.snapshots = snapshots
+}
+
+func (conn *Conn) PeerKey() string {
+	return conn.peerKey
+}
+
+func (conn *Conn) SetPeerKey(peerKey string) {
+	conn.peerKey = peerKey
+}
+
+func (conn *Conn) SetReadTimeout(timeout time.Duration) {
+	conn.readTimeout = timeout
+}
+
+func (conn *Conn) SetWriteTimeout(timeout time.Duration) {
+	conn.writeTimeout = timeout
+}
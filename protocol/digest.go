@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/crdts"
+	"bftkvstore/logger"
+	"bftkvstore/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+// Peers that negotiated digests compare their heads as a tree instead of
+// sending the heads of every key. Keys are placed by the hex encoded SHA-256
+// of their name, a range holds the keys whose position starts with its
+// prefix, and its digest hashes the heads of those keys. A node sends the
+// digest of the whole range; the peer answers a different digest with the
+// digests of the 16 subranges, and both descend into the ones that differ.
+// Ranges with few keys are settled by sending the heads of their keys both
+// ways.
+const (
+	_DIGEST_LEAF_KEYS = 8
+	_DIGEST_MAX_DEPTH = 16 // hex digits, deeper ranges are settled by their heads
+)
+
+const _HEX_DIGITS = "0123456789abcdef"
+
+type digestDTO struct {
+	Prefix    string   `json:"prefix"`
+	Digest    string   `json:"digest,omitempty"`    // empty for a range without keys
+	Children  []string `json:"children,omitempty"`  // digests of the subranges, in order
+	SendHeads bool     `json:"sendHeads,omitempty"` // asks for the heads of the keys of the range
+}
+
+type keyHeads struct {
+	key      string
+	position string
+	heads    []string
+}
+
+// Returns the keys in the range ordered by position
+func keysInRange(ctx *context.AppContext, prefix string) []keyHeads {
+	keys := make([]keyHeads, 0)
+	for key, heads := range ctx.Storage.GetHeads() {
+		position := sha256.Sum256([]byte(key))
+		if encoded := hex.EncodeToString(position[:]); strings.HasPrefix(encoded, prefix) {
+			keys = append(keys, keyHeads{key: key, position: encoded, heads: utils.Map(heads, crdts.HashOperation)})
+		}
+	}
+
+	slices.SortFunc(keys, func(a keyHeads, b keyHeads) int {
+		return strings.Compare(a.position, b.position)
+	})
+	return keys
+}
+
+func rangeDigest(keys []keyHeads) string {
+	if len(keys) == 0 {
+		return ""
+	}
+
+	hash := sha256.New()
+	for _, key := range keys {
+		heads := slices.Clone(key.heads)
+		slices.Sort(heads)
+
+		hash.Write([]byte(key.key))
+		for _, head := range heads {
+			hash.Write([]byte{0})
+			hash.Write(hashBytes(head))
+		}
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func childDigests(keys []keyHeads, prefix string) []string {
+	children := make([]string, len(_HEX_DIGITS))
+	for idx, digit := range _HEX_DIGITS {
+		children[idx] = rangeDigest(slices.DeleteFunc(slices.Clone(keys), func(key keyHeads) bool {
+			return key.position[len(prefix)] != byte(digit)
+		}))
+	}
+	return children
+}
+
+func isValidPrefix(prefix string) bool {
+	return len(prefix) <= _DIGEST_MAX_DEPTH && strings.Trim(prefix, _HEX_DIGITS) == ""
+}
+
+func sendDigest(ctx *context.AppContext, connData *connectionData, prefix string) {
+	digest := rangeDigest(keysInRange(ctx, prefix))
+	NewMessage(DIGEST).AddContent(digestDTO{Prefix: prefix, Digest: digest}).Send(connData.conn)
+}
+
+func sendRangeHeads(ctx *context.AppContext, connData *connectionData, keys []keyHeads) {
+	for _, key := range keys {
+		newHeadsMessage(ctx, connData, key.key, key.heads).Send(connData.conn)
+	}
+}
+
+func onReceivingDigest(ctx *context.AppContext, connData *connectionData, body []byte) {
+	if downloadingSnapshot() {
+		return
+	}
+
+	data, err := unmarshallJson[digestDTO](body)
+	if err != nil {
+		logger.Error("Failed to parse digest JSON", err)
+		return
+	}
+	if !isValidPrefix(data.Prefix) || (len(data.Children) != 0 && len(data.Children) != len(_HEX_DIGITS)) {
+		logger.Alert("Ignoring a malformed digest from", connData.name)
+		return
+	}
+
+	keys := keysInRange(ctx, data.Prefix)
+
+	switch {
+	case data.SendHeads:
+		sendRangeHeads(ctx, connData, keys)
+
+	case len(data.Children) > 0:
+		// only the subranges that differ are compared further
+		if len(data.Prefix) == _DIGEST_MAX_DEPTH {
+			return
+		}
+		for idx, child := range childDigests(keys, data.Prefix) {
+			if child != data.Children[idx] {
+				sendDigest(ctx, connData, data.Prefix+string(_HEX_DIGITS[idx]))
+			}
+		}
+
+	case rangeDigest(keys) != data.Digest:
+		if len(keys) <= _DIGEST_LEAF_KEYS || len(data.Prefix) == _DIGEST_MAX_DEPTH {
+			sendRangeHeads(ctx, connData, keys)
+			NewMessage(DIGEST).AddContent(digestDTO{Prefix: data.Prefix, SendHeads: true}).Send(connData.conn)
+			return
+		}
+		NewMessage(DIGEST).AddContent(digestDTO{
+			Prefix:   data.Prefix,
+			Digest:   rangeDigest(keys),
+			Children: childDigests(keys, data.Prefix),
+		}).Send(connData.conn)
+	}
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/crdts"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+)
+
+// Keeps what is written to it to be read back
+type bufferConn struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (conn *bufferConn) Write(b []byte) (int, error) { return conn.buffer.Write(b) }
+func (conn *bufferConn) Read(b []byte) (int, error)  { return conn.buffer.Read(b) }
+
+type digestTestNode struct {
+	ctx      context.AppContext
+	connData *connectionData
+	written  *bufferConn
+	heads    map[string]bool // keys whose heads the node received
+}
+
+func newDigestTestNode() *digestTestNode {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	written := &bufferConn{}
+	return &digestTestNode{
+		ctx:      context.New(secretkey, "127.0.0.1", "8089"),
+		connData: &connectionData{name: "peer", conn: NewConn(written)},
+		written:  written,
+		heads:    make(map[string]bool),
+	}
+}
+
+// The messages the node sent since the last call
+func (node *digestTestNode) sent() []Message {
+	reader := NewConn(node.written)
+	messages := make([]Message, 0)
+	for {
+		payload, _, err := ReadFromConnection(reader)
+		if err != nil {
+			return messages
+		}
+		msg, _ := MessageFromPayload(payload)
+		messages = append(messages, msg)
+	}
+}
+
+// Compares the digests of both nodes until neither has anything more to send,
+// returning how many digests were exchanged
+func exchangeDigests(t *testing.T, first *digestTestNode, second *digestTestNode) int {
+	type delivery struct {
+		to  *digestTestNode
+		msg Message
+	}
+
+	sendDigest(&first.ctx, first.connData, "")
+	pending := make([]delivery, 0)
+	for _, msg := range first.sent() {
+		pending = append(pending, delivery{second, msg})
+	}
+
+	digests := 0
+	for len(pending) > 0 {
+		next := pending[0]
+		pending = pending[1:]
+		other := first
+		if next.to == first {
+			other = second
+		}
+
+		switch next.msg.header {
+		case DIGEST:
+			if digests++; digests > 10000 {
+				t.Fatal("The comparison of the digests does not end")
+			}
+			onReceivingDigest(&next.to.ctx, next.to.connData, next.msg.content)
+			for _, msg := range next.to.sent() {
+				pending = append(pending, delivery{other, msg})
+			}
+		case HEADS:
+			data, err := unmarshallJson[headsDTO](next.msg.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next.to.heads[data.Key] = true
+		}
+	}
+	return digests
+}
+
+func TestDigestDescent(t *testing.T) {
+	first, second := newDigestTestNode(), newDigestTestNode()
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for range 200 {
+		op, _, _ := crdts.NewCounterOp(secretkey)
+		for _, node := range []*digestTestNode{first, second} {
+			if err := node.ctx.Storage.Assign(crdts.HashOperation(op), op); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if digests := exchangeDigests(t, first, second); digests != 1 || len(first.heads)+len(second.heads) != 0 {
+		t.Fatal("Expected the same keys to be settled by a single digest but exchanged", digests, "digests")
+	}
+
+	// a key only the first node has and one the second node updated
+	created, _, _ := crdts.NewCounterOp(secretkey)
+	first.ctx.Storage.Assign(crdts.HashOperation(created), created)
+	updatedKey := second.ctx.Storage.List()[0].Key
+	heads, _ := second.ctx.Storage.Get(updatedKey)
+	inc, _ := crdts.IncCounterOp(secretkey, 1, heads.Heads)
+	second.ctx.Storage.Append(updatedKey, inc)
+
+	exchangeDigests(t, first, second)
+
+	if !second.heads[crdts.HashOperation(created)] {
+		t.Error("Expected the heads of the new key to be sent to the node without it")
+	}
+	if !first.heads[updatedKey] || !second.heads[updatedKey] {
+		t.Error("Expected the heads of the updated key to be sent both ways")
+	}
+	// only the keys of the leaf ranges of the differing keys are sent
+	if len(first.heads) > 2*_DIGEST_LEAF_KEYS || len(second.heads) > 2*_DIGEST_LEAF_KEYS {
+		t.Error("Expected the heads of a few keys but got", len(first.heads), "and", len(second.heads))
+	}
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bftkvstore/crdts"
+	"bftkvstore/storage"
+	"errors"
+)
+
+// Failed requests are answered with an errorDTO as content, under R_ER when
+// the request could not be read (an unknown header, or a body that can not be
+// parsed or misses fields) and under R_NO for any other failure. The header
+// follows from the code, so every handler answers the same way.
+type ErrorCode string
+
+const (
+	ERR_MALFORMED_REQUEST     ErrorCode = "MALFORMED_REQUEST"     // the body could not be parsed or misses fields
+	ERR_UNKNOWN_HEADER        ErrorCode = "UNKNOWN_HEADER"        // the message header is not handled
+	ERR_UNKNOWN_KEY           ErrorCode = "UNKNOWN_KEY"           // no key (or alias) with that name exists
+	ERR_KEY_EXISTS            ErrorCode = "KEY_EXISTS"            // the key is already assigned
+	ERR_UNKNOWN_CRDT_TYPE     ErrorCode = "UNKNOWN_CRDT_TYPE"     // there is no CRDT of that type
+	ERR_UNSUPPORTED_OPERATION ErrorCode = "UNSUPPORTED_OPERATION" // the CRDT of the key has no such operation
+	ERR_WRONG_VALUE_TYPE      ErrorCode = "WRONG_VALUE_TYPE"      // the value does not fit the operation
+	ERR_INVALID_OPERATION     ErrorCode = "INVALID_OPERATION"     // the operation is not correctly signed or encoded
+	ERR_TYPE_MISMATCH         ErrorCode = "TYPE_MISMATCH"         // the operation is not of the type of the key
+	ERR_UNKNOWN_PREDECESSORS  ErrorCode = "UNKNOWN_PREDECESSORS"  // the operation depends on unknown operations
+	ERR_UNKNOWN_OPERATION     ErrorCode = "UNKNOWN_OPERATION"     // an operation hash is not in the key
+	ERR_CONFLICT              ErrorCode = "CONFLICT"              // the heads of the key are not the expected ones
+	ERR_ALIAS_TAKEN           ErrorCode = "ALIAS_TAKEN"           // the alias or its namespace is claimed by others
+	ERR_CONNECTION_FAILED     ErrorCode = "CONNECTION_FAILED"     // could not connect to the requested node
+	ERR_UNAUTHENTICATED       ErrorCode = "UNAUTHENTICATED"       // the node did not prove its key
+	ERR_NOT_ALLOWED           ErrorCode = "NOT_ALLOWED"           // the key of the node is not in the allowlist, or the sender is not an operator
+	ERR_INTERNAL              ErrorCode = "INTERNAL"              // anything else
+)
+
+var (
+	errUnsupportedOperation = errors.New("No such operation exists for the CRDT")
+	errWrongValueType       = errors.New("Provided the wrong value type for the operation")
+)
+
+type errorDTO struct {
+	Code    ErrorCode   `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func NewErrorMessage(code ErrorCode, message string, details interface{}) Message {
+	return NewMessage(errorHeaderOf(code)).AddContent(errorDTO{
+		Code:    code,
+		Message: message,
+		Details: details,
+	})
+}
+
+// Builds the error response of an error returned by storage, crdts or the
+// protocol itself
+func errorMessageFrom(err error, details interface{}) Message {
+	return NewErrorMessage(errorCodeOf(err), err.Error(), details)
+}
+
+func errorHeaderOf(code ErrorCode) MessageHeader {
+	switch code {
+	case ERR_MALFORMED_REQUEST, ERR_UNKNOWN_HEADER:
+		return ERR
+	default:
+		return NO
+	}
+}
+
+func errorCodeOf(err error) ErrorCode {
+	switch {
+	case errors.Is(err, storage.ErrKeyNotFound):
+		return ERR_UNKNOWN_KEY
+	case errors.Is(err, storage.ErrKeyExists):
+		return ERR_KEY_EXISTS
+	case errors.Is(err, storage.ErrInvalidOperation), errors.Is(err, crdts.ErrInvalidOperation):
+		return ERR_INVALID_OPERATION
+	case errors.Is(err, storage.ErrTypeMismatch):
+		return ERR_TYPE_MISMATCH
+	case errors.Is(err, storage.ErrUnknownPreds):
+		return ERR_UNKNOWN_PREDECESSORS
+	case errors.Is(err, storage.ErrUnknownOperation):
+		return ERR_UNKNOWN_OPERATION
+	case errors.Is(err, storage.ErrHeadsChanged):
+		return ERR_CONFLICT
+	case errors.Is(err, crdts.ErrUnknownCrdtType):
+		return ERR_UNKNOWN_CRDT_TYPE
+	case errors.Is(err, errUnsupportedOperation):
+		return ERR_UNSUPPORTED_OPERATION
+	case errors.Is(err, errWrongValueType):
+		return ERR_WRONG_VALUE_TYPE
+	default:
+		return ERR_INTERNAL
+	}
+}
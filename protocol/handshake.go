@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// Nodes prove their keys during the CON? handshake. The dialer sends its key
+// and a nonce, the responder answers with its key, its own nonce and a
+// signature of the transcript, and the dialer proves its key with an AUTH
+// message signing the transcript too. The transcript holds both nonces and
+// keys, prefixed with the role of the signer so a signature can not be
+// replayed in the other direction.
+const (
+	_HANDSHAKE_NONCE_SIZE = 32
+
+	_HANDSHAKE_DIALER    = "bftkvstore handshake dialer"
+	_HANDSHAKE_RESPONDER = "bftkvstore handshake responder"
+)
+
+var errUnauthenticated = errors.New("The node failed to prove its key")
+
+type authDTO struct {
+	Signature string `json:"signature"`
+}
+
+type handshakeTranscript struct {
+	DialerNonce, ResponderNonce string
+	DialerKey, ResponderKey     string
+}
+
+func newHandshakeNonce() (string, error) {
+	nonce := make([]byte, _HANDSHAKE_NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+func (t handshakeTranscript) bytes(role string) ([]byte, error) {
+	transcript := []byte(role)
+	for _, part := range []string{t.DialerNonce, t.ResponderNonce, t.DialerKey, t.ResponderKey} {
+		decoded, err := hex.DecodeString(part)
+		if err != nil || len(decoded) != 32 { // nonces and keys have the same size
+			return nil, errUnauthenticated
+		}
+		transcript = append(transcript, decoded...)
+	}
+	return transcript, nil
+}
+
+func (t handshakeTranscript) sign(ctx *context.AppContext, role string) (string, error) {
+	transcript, err := t.bytes(role)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ed25519.Sign(ctx.Secretkey, transcript)), nil
+}
+
+func (t handshakeTranscript) verify(role string, publicKey string, signature string) error {
+	transcript, err := t.bytes(role)
+	if err != nil {
+		return err
+	}
+
+	key, keyErr := hex.DecodeString(publicKey)
+	sig, sigErr := hex.DecodeString(signature)
+	if keyErr != nil || sigErr != nil || len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, transcript, sig) {
+		return errUnauthenticated
+	}
+	return nil
+}
+
+func isAllowedKey(ctx *context.AppContext, publicKey string) bool {
+	return ctx.AllowedKeys == nil || ctx.AllowedKeys[publicKey]
+}
@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+)
+
+func newHandshakeTestContext() context.AppContext {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	return context.New(secretkey, "127.0.0.1", "8089")
+}
+
+func TestHandshakeTranscript(t *testing.T) {
+	dialer, responder := newHandshakeTestContext(), newHandshakeTestContext()
+	dialerNonce, _ := newHandshakeNonce()
+	responderNonce, _ := newHandshakeNonce()
+	transcript := handshakeTranscript{
+		DialerNonce:    dialerNonce,
+		ResponderNonce: responderNonce,
+		DialerKey:      ownPublicKey(&dialer),
+		ResponderKey:   ownPublicKey(&responder),
+	}
+
+	signature, err := transcript.sign(&responder, _HANDSHAKE_RESPONDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherNonce, _ := newHandshakeNonce()
+
+	tests := []struct {
+		name       string
+		transcript handshakeTranscript
+		role       string
+		publicKey  string
+		signature  string
+		valid      bool
+	}{
+		{"valid", transcript, _HANDSHAKE_RESPONDER, transcript.ResponderKey, signature, true},
+		{"other role", transcript, _HANDSHAKE_DIALER, transcript.ResponderKey, signature, false},
+		{"other key", transcript, _HANDSHAKE_RESPONDER, transcript.DialerKey, signature, false},
+		{"other nonce", func() handshakeTranscript {
+			other := transcript
+			other.DialerNonce = otherNonce
+			return other
+		}(), _HANDSHAKE_RESPONDER, transcript.ResponderKey, signature, false},
+		{"missing nonce", func() handshakeTranscript {
+			other := transcript
+			other.ResponderNonce = ""
+			return other
+		}(), _HANDSHAKE_RESPONDER, transcript.ResponderKey, signature, false},
+		{"missing signature", transcript, _HANDSHAKE_RESPONDER, transcript.ResponderKey, "", false},
+		{"malformed signature", transcript, _HANDSHAKE_RESPONDER, transcript.ResponderKey, signature[:len(signature)-2], false},
+	}
+
+	for _, test := range tests {
+		err := test.transcript.verify(test.role, test.publicKey, test.signature)
+		if test.valid && err != nil {
+			t.Error(test.name, "should be accepted but got", err)
+		}
+		if !test.valid && !errors.Is(err, errUnauthenticated) {
+			t.Error(test.name, "should be rejected but got", err)
+		}
+	}
+}
+
+// Answers the CON? of the dialer like an older node, without a signature
+func answerWithoutSignature(t *testing.T, server net.Conn, responder *context.AppContext) {
+	defer server.Close()
+	conn := NewConn(server)
+	if _, _, err := ReadFromConnection(conn); err != nil {
+		t.Error(err)
+		return
+	}
+	NewMessage(OK).AddContent(connectHandshakeDTO{
+		Address:   responder.Address,
+		Port:      responder.Port,
+		PublicKey: ownPublicKey(responder),
+	}).Send(conn)
+}
+
+func TestConnectHandshakeWithoutSignature(t *testing.T) {
+	responder := newHandshakeTestContext()
+
+	tests := []struct {
+		name                 string
+		allowUnauthenticated bool
+		allowedKeys          map[string]bool
+		valid                bool
+	}{
+		{"by default", false, nil, false},
+		{"allowed", true, nil, true},
+		{"allowed with an allowlist", true, map[string]bool{ownPublicKey(&responder): true}, false},
+	}
+
+	for _, test := range tests {
+		dialer := newHandshakeTestContext()
+		dialer.AllowUnauthenticated = test.allowUnauthenticated
+		dialer.AllowedKeys = test.allowedKeys
+
+		client, server := net.Pipe()
+		go answerWithoutSignature(t, server, &responder)
+		conn := NewConn(client)
+		err := connectHandshake(&dialer, conn, nil)
+		client.Close()
+
+		if test.valid && (err != nil || conn.PeerKey() != "") {
+			t.Error(test.name, "should be accepted without a key but got", err, conn.PeerKey())
+		}
+		if !test.valid && !errors.Is(err, errUnauthenticated) {
+			t.Error(test.name, "should be rejected but got", err)
+		}
+	}
+}
+
+func TestConnectHandshakeWithoutNonce(t *testing.T) {
+	dialer := newHandshakeTestContext()
+	body := `{"address":"127.0.0.1","port":"8090","publicKey":"` + ownPublicKey(&dialer) + `"}`
+
+	tests := []struct {
+		name                 string
+		allowUnauthenticated bool
+		allowedKeys          map[string]bool
+		valid                bool
+	}{
+		{"by default", false, nil, false},
+		{"allowed", true, nil, true},
+		{"allowed with an allowlist", true, map[string]bool{ownPublicKey(&dialer): true}, false},
+	}
+
+	for _, test := range tests {
+		responder := newHandshakeTestContext()
+		responder.AllowUnauthenticated = test.allowUnauthenticated
+		responder.AllowedKeys = test.allowedKeys
+
+		nodes := make(chan context.Node, 1)
+		go func() { nodes <- <-responder.NewNodes }()
+
+		reply := requestHandler(t, func(conn *Conn, body []byte) { qConnectMsg(&responder, conn, body) }, body)
+
+		if test.valid {
+			if reply.header != OK {
+				t.Error(test.name, "should be accepted but got", string(reply.header), string(reply.content))
+			} else if node := <-nodes; node.Conn.(*Conn).PeerKey() != "" {
+				t.Error(test.name, "should not take the unproven key", node.Conn.(*Conn).PeerKey())
+			}
+			continue
+		}
+		if reply.header != NO {
+			t.Error(test.name, "should be rejected but got", string(reply.header))
+		} else if reason, err := unmarshallJson[errorDTO](reply.content); err != nil || reason.Code != ERR_UNAUTHENTICATED {
+			t.Error(test.name, "should be refused as unauthenticated but got", string(reply.content))
+		}
+	}
+}
+
+func TestConnectHandshake(t *testing.T) {
+	dialer, responder := newHandshakeTestContext(), newHandshakeTestContext()
+	responderKey := responder.Secretkey.Public().(ed25519.PublicKey)
+	_, otherSecretkey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name        string
+		expectedKey ed25519.PublicKey
+		allowedKeys map[string]bool
+		valid       bool
+	}{
+		{"any key", nil, nil, true},
+		{"expected key", responderKey, nil, true},
+		{"other key than expected", otherSecretkey.Public().(ed25519.PublicKey), nil, false},
+		{"allowed key", nil, map[string]bool{hex.EncodeToString(responderKey): true}, true},
+		{"key not allowed", nil, map[string]bool{}, false},
+	}
+
+	for _, test := range tests {
+		dialer.AllowedKeys = test.allowedKeys
+
+		client, server := net.Pipe()
+		accepted := make(chan bool, 1)
+		go func() {
+			defer server.Close()
+			conn := NewConn(server)
+			payload, _, err := ReadFromConnection(conn)
+			msg, ok := MessageFromPayload(payload)
+			if err != nil || !ok || msg.header != Q_CONNECT {
+				accepted <- false
+				return
+			}
+			go func() { <-responder.NewNodes }()
+			accepted <- qConnectMsg(&responder, conn, msg.content)
+		}()
+
+		conn := NewConn(client)
+		err := connectHandshake(&dialer, conn, test.expectedKey)
+		client.Close()
+
+		if test.valid && (err != nil || !<-accepted || conn.PeerKey() != hex.EncodeToString(responderKey)) {
+			t.Error(test.name, "should be accepted but got", err)
+		}
+		if !test.valid && err == nil {
+			t.Error(test.name, "should be rejected")
+		}
+	}
+}
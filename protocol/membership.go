@@ -0,0 +1,431 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/logger"
+	stdcontext "context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	MEMBERS_FILE   = "members.json"
+	DEFAULT_FANOUT = 8
+
+	_MEMBERSHIP_ROUTINE_SECONDS = 10
+	_MAX_MEMBER_FAILURES        = 3  // failed dials before a node is forgotten
+	_MAX_SHARED_MEMBERS         = 64 // nodes shared, and accepted, per message
+	_MAX_MEMBER_ADDRESSES       = 4  // addresses kept per node
+	_MAX_MEMBERS                = 1024
+)
+
+// The membership view holds every node this node knows about, either because
+// it was connected to it or because a peer shared it. Nodes dial random
+// members until they are connected to fanout peers, so a single connection
+// to any node of the cluster is enough to join it.
+type memberDTO struct {
+	Address   string   `json:"address"`
+	Port      string   `json:"port"`
+	PublicKey string   `json:"publicKey,omitempty"` // hex encoded, as told by the node or a peer
+	Addresses []string `json:"addresses,omitempty"` // other host:port the node advertises
+}
+
+type peersDTO struct {
+	Peers []memberDTO `json:"peers"`
+}
+
+var lockMembers sync.Mutex
+var members map[string]memberDTO = make(map[string]memberDTO)
+var memberFailures map[string]int = make(map[string]int)
+var membersPath string
+
+var membersChanged chan struct{} = make(chan struct{}, 1)
+
+func (member memberDTO) name() string {
+	return net.JoinHostPort(member.Address, member.Port)
+}
+
+// The addresses to dial the member at, in order
+func (member memberDTO) dialAddresses() []string {
+	addresses := []string{member.name()}
+	for _, address := range member.Addresses {
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+func (member memberDTO) equal(other memberDTO) bool {
+	return member.Address == other.Address && member.Port == other.Port &&
+		member.PublicKey == other.PublicKey && slices.Equal(member.Addresses, other.Addresses)
+}
+
+// Loads the membership view saved at path and dials members until runCtx is
+// done, keeping the view saved there as it changes
+func StartMembership(runCtx stdcontext.Context, ctx *context.AppContext, path string, fanout int) {
+	lockMembers.Lock()
+	membersPath = path
+	if saved, err := os.ReadFile(path); err == nil {
+		loaded, err := unmarshallJson[[]memberDTO](saved)
+		if err != nil {
+			logger.Error("Failed to parse the membership view", err)
+		}
+		for _, member := range loaded {
+			if isValidMember(ctx, member) && len(members) < _MAX_MEMBERS {
+				members[member.name()] = member
+			}
+		}
+		logger.Info("Loaded", len(members), "members")
+	} else if !os.IsNotExist(err) {
+		logger.Error("Failed to read the membership view", err)
+	}
+	lockMembers.Unlock()
+
+	routine := time.NewTicker(_MEMBERSHIP_ROUTINE_SECONDS * time.Second)
+	defer routine.Stop()
+
+	for {
+		maintainFanout(runCtx, ctx, fanout)
+
+		select {
+		case <-routine.C:
+		case <-membersChanged:
+		case <-runCtx.Done():
+			return
+		}
+	}
+}
+
+func isValidMember(ctx *context.AppContext, member memberDTO) bool {
+	if member.Address == "" || member.Port == "" {
+		return false
+	}
+	if member.PublicKey != "" {
+		key, err := hex.DecodeString(member.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return false
+		}
+	}
+
+	// the node itself
+	return member.PublicKey != ownPublicKey(ctx) && (member.Address != ctx.Address || member.Port != ctx.Port) &&
+		!slices.Contains(ctx.Addresses, member.name())
+}
+
+func ownPublicKey(ctx *context.AppContext) string {
+	return hex.EncodeToString(ctx.Secretkey.Public().(ed25519.PublicKey))
+}
+
+// Adds the members to the view, members already known keep their key unless
+// they are peers, which told it during the handshake. A node is known by the
+// address it was last connected with, and the other addresses it advertised.
+func addMembers(ctx *context.AppContext, added []memberDTO, isPeer bool) {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+
+	changed := false
+	for _, member := range added {
+		if !isValidMember(ctx, member) {
+			continue
+		}
+
+		known, exists := members[member.name()]
+		if isPeer {
+			delete(memberFailures, member.name())
+		}
+		if exists && (known.equal(member) || !isPeer) {
+			continue
+		}
+
+		if sameKey, found := memberWithKey(member.PublicKey); found {
+			if !isPeer {
+				continue
+			}
+			if member.Addresses == nil {
+				member.Addresses = sameKey.Addresses
+			}
+			if member.equal(sameKey) {
+				continue
+			}
+			delete(members, sameKey.name())
+		}
+
+		if _, exists := members[member.name()]; !exists && len(members) >= _MAX_MEMBERS && !evictMember(isPeer) {
+			continue
+		}
+
+		members[member.name()] = member
+		changed = true
+	}
+
+	if changed {
+		saveMembers()
+		select {
+		case membersChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Makes room in a full view by forgetting the member that failed the most,
+// or any member for a peer. Must be called with lockMembers held.
+func evictMember(forPeer bool) (evicted bool) {
+	victim, failures := "", 0
+	for name := range members {
+		if memberFailures[name] > failures || (forPeer && victim == "") {
+			victim, failures = name, memberFailures[name]
+		}
+	}
+	if victim == "" {
+		return false
+	}
+
+	delete(members, victim)
+	delete(memberFailures, victim)
+	return true
+}
+
+// Must be called with lockMembers held
+func memberWithKey(publicKey string) (member memberDTO, found bool) {
+	if publicKey == "" {
+		return member, false
+	}
+	for _, member := range members {
+		if member.PublicKey == publicKey {
+			return member, true
+		}
+	}
+	return member, false
+}
+
+func forgetMember(member memberDTO) {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+
+	memberFailures[member.name()]++
+	if memberFailures[member.name()] >= _MAX_MEMBER_FAILURES {
+		logger.Info("Forgetting unreachable member", member.name())
+		delete(members, member.name())
+		delete(memberFailures, member.name())
+		saveMembers()
+	}
+}
+
+// Must be called with lockMembers held
+func saveMembers() {
+	if membersPath == "" {
+		return
+	}
+
+	view := make([]memberDTO, 0, len(members))
+	for _, member := range members {
+		view = append(view, member)
+	}
+	serialized, err := json.MarshalIndent(view, "", "\t")
+	if err != nil {
+		logger.Error("Failed to serialize the membership view", err)
+		return
+	}
+
+	// written aside and renamed so a crash never leaves half a file
+	tmpPath := membersPath + ".tmp"
+	if err := os.WriteFile(tmpPath, serialized, 0644); err != nil {
+		logger.Error("Failed to save the membership view", err)
+		return
+	}
+	if err := os.Rename(tmpPath, membersPath); err != nil {
+		logger.Error("Failed to save the membership view", err)
+	}
+}
+
+// Keeps the addresses a peer advertises for itself
+func setMemberAddresses(publicKey string, addresses []string) {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+
+	member, found := memberWithKey(publicKey)
+	if !found || slices.Equal(member.Addresses, addresses) {
+		return
+	}
+
+	member.Addresses = addresses
+	members[member.name()] = member
+	saveMembers()
+}
+
+// Keeps the first few addresses of a node shared by a peer, without the ones
+// that are not worth dialing, nor loopback ones unless the peer is itself on
+// this host
+func dialableAddresses(addresses []string, from net.Addr) []string {
+	fromLoopback := false
+	if host, _, err := net.SplitHostPort(from.String()); err == nil {
+		ip := net.ParseIP(host)
+		fromLoopback = ip != nil && ip.IsLoopback()
+	}
+
+	dialable := make([]string, 0)
+	for _, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || host == "" || port == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && (ip.IsUnspecified() || ip.IsMulticast() || (ip.IsLoopback() && !fromLoopback)) {
+			continue
+		}
+		if !slices.Contains(dialable, address) {
+			dialable = append(dialable, address)
+		}
+		if len(dialable) == _MAX_MEMBER_ADDRESSES {
+			break
+		}
+	}
+	return dialable
+}
+
+// Sends the node itself and a random sample of its members to the peer
+func sharePeers(ctx *context.AppContext, connData *connectionData) {
+	shared := []memberDTO{{Address: ctx.Address, Port: ctx.Port, PublicKey: ownPublicKey(ctx), Addresses: ctx.Addresses}}
+
+	lockMembers.Lock()
+	for _, member := range members {
+		shared = append(shared, member)
+	}
+	lockMembers.Unlock()
+
+	rand.Shuffle(len(shared)-1, func(i, j int) {
+		shared[i+1], shared[j+1] = shared[j+1], shared[i+1]
+	})
+	shared = shared[:min(len(shared), _MAX_SHARED_MEMBERS)]
+
+	if err := NewMessage(PEERS).AddContent(peersDTO{Peers: shared}).Send(connData.conn); err != nil {
+		logger.Alert("Failed to share peers with", connData.name, err)
+	}
+}
+
+// Only peers that proved an allowed key share members, and only members with
+// a key are kept as no other can be dialed
+func onReceivingPeers(ctx *context.AppContext, connData *connectionData, body []byte) {
+	peerKey := connData.conn.PeerKey()
+	if peerKey == "" || !isAllowedKey(ctx, peerKey) {
+		logger.Alert("Ignored the peers shared by the unauthenticated node", connData.name)
+		return
+	}
+
+	data, err := unmarshallJson[peersDTO](body)
+	if err != nil {
+		logger.Error("Failed to parse peers JSON", err)
+		return
+	}
+
+	from := connData.conn.RemoteAddr()
+	shared := make([]memberDTO, 0)
+	for _, member := range data.Peers[:min(len(data.Peers), _MAX_SHARED_MEMBERS)] {
+		if member.PublicKey == "" {
+			continue
+		}
+		if member.Addresses != nil {
+			member.Addresses = dialableAddresses(member.Addresses, from)
+		}
+		shared = append(shared, member)
+	}
+	addMembers(ctx, shared, false)
+
+	// only the peer itself tells its own addresses
+	for _, member := range shared {
+		if member.PublicKey == peerKey {
+			setMemberAddresses(peerKey, dialableAddresses(append([]string{member.name()}, member.Addresses...), from))
+		}
+	}
+}
+
+// Dials random members that are not connected while there are fewer than
+// fanout peers, members must have a known and allowed key to be dialed
+func maintainFanout(runCtx stdcontext.Context, ctx *context.AppContext, fanout int) {
+	connected := make(map[string]bool)
+	lockConnections.Lock()
+	for _, connData := range connections {
+		connected[connData.name] = true
+		if peerKey := connData.conn.PeerKey(); peerKey != "" {
+			connected[peerKey] = true
+		}
+	}
+	for name := range redialing {
+		connected[name] = true
+	}
+	missing := fanout - len(connections)
+	lockConnections.Unlock()
+
+	if missing <= 0 {
+		return
+	}
+
+	candidates := make([]memberDTO, 0)
+	lockMembers.Lock()
+	for name, member := range members {
+		if member.PublicKey != "" && isAllowedKey(ctx, member.PublicKey) && !connected[name] && !connected[member.PublicKey] {
+			candidates = append(candidates, member)
+		}
+	}
+	lockMembers.Unlock()
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, member := range candidates[:min(len(candidates), missing)] {
+		go dialMember(runCtx, ctx, member)
+	}
+}
+
+// Dials a member once, peers found through the membership are not redialed
+// as other members can take their place. The member must prove its key.
+func dialMember(runCtx stdcontext.Context, ctx *context.AppContext, member memberDTO) {
+	name := member.name()
+	expectedKey, err := hex.DecodeString(member.PublicKey)
+	if err != nil || len(expectedKey) != ed25519.PublicKeySize {
+		logger.Alert("Not dialing the member without a valid key", name)
+		return
+	}
+
+	lockConnections.Lock()
+	if redialing[name] {
+		lockConnections.Unlock()
+		return
+	}
+	redialing[name] = true
+	lockConnections.Unlock()
+
+	defer func() {
+		lockConnections.Lock()
+		delete(redialing, name)
+		lockConnections.Unlock()
+	}()
+
+	var conn *Conn
+	var host, port string
+	for _, address := range member.dialAddresses() {
+		host, port, _ = net.SplitHostPort(address)
+		if conn, err = ConnectTo(runCtx, ctx, host, port, expectedKey); err == nil {
+			break
+		}
+		logger.Alert("Failed to connect to member", address, err)
+	}
+	if err != nil {
+		forgetMember(member)
+		return
+	}
+
+	logger.Info("Connected to member", net.JoinHostPort(host, port))
+	select {
+	case ctx.NewNodes <- context.Node{Address: host, Port: port, Conn: conn, Dialed: true}:
+	case <-runCtx.Done():
+		conn.Close()
+	}
+}
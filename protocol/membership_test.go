@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func resetMembers() {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+	members = make(map[string]memberDTO)
+	memberFailures = make(map[string]int)
+	membersPath = ""
+}
+
+func newTestMember(idx int) memberDTO {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return memberDTO{Address: fmt.Sprintf("10.%d.%d.%d", idx>>16&0xFF, idx>>8&0xFF, idx&0xFF), Port: "8089", PublicKey: hex.EncodeToString(key)}
+}
+
+func isMember(member memberDTO) bool {
+	lockMembers.Lock()
+	defer lockMembers.Unlock()
+	_, exists := members[member.name()]
+	return exists
+}
+
+func TestMembershipCap(t *testing.T) {
+	ctx := newHandshakeTestContext()
+	resetMembers()
+	defer resetMembers()
+
+	full := make([]memberDTO, 0, _MAX_MEMBERS)
+	for idx := range _MAX_MEMBERS {
+		full = append(full, newTestMember(idx))
+	}
+	addMembers(&ctx, full, false)
+
+	// shared members do not take the place of members that never failed
+	shared := newTestMember(_MAX_MEMBERS)
+	addMembers(&ctx, []memberDTO{shared}, false)
+	if len(members) != _MAX_MEMBERS || isMember(shared) {
+		t.Fatal("Expected the full view to keep its members but it has", len(members), "members")
+	}
+
+	// nor of the ones that failed less often than the rest
+	memberFailures[full[0].name()] = 1
+	memberFailures[full[1].name()] = 2
+	addMembers(&ctx, []memberDTO{shared}, false)
+	if len(members) != _MAX_MEMBERS || !isMember(shared) || isMember(full[1]) || !isMember(full[0]) {
+		t.Error("Expected the member that failed the most to be evicted")
+	}
+
+	// peers always find a place
+	peer := newTestMember(_MAX_MEMBERS + 1)
+	addMembers(&ctx, []memberDTO{peer}, true)
+	if len(members) != _MAX_MEMBERS || !isMember(peer) || isMember(full[0]) {
+		t.Error("Expected the peer to take the place of the member that failed")
+	}
+	evicted := 0
+	for _, member := range full {
+		if !isMember(member) {
+			evicted++
+		}
+	}
+	if evicted != 2 {
+		t.Error("Expected 2 members to be evicted but", evicted, "were")
+	}
+
+	// unreachable members are forgotten after a few failures
+	for range _MAX_MEMBER_FAILURES {
+		forgetMember(shared)
+	}
+	if isMember(shared) || len(members) != _MAX_MEMBERS-1 {
+		t.Error("Expected the unreachable member to be forgotten")
+	}
+}
+
+func TestReceivingPeers(t *testing.T) {
+	ctx := newHandshakeTestContext()
+	resetMembers()
+	defer resetMembers()
+
+	shared := []memberDTO{newTestMember(0), newTestMember(1), {Address: "10.0.0.2", Port: "8089"}}
+	body, _ := json.Marshal(peersDTO{Peers: shared})
+	peerKey := shared[1].PublicKey
+
+	tests := []struct {
+		name        string
+		peerKey     string
+		allowedKeys map[string]bool
+		members     int
+	}{
+		{"unauthenticated peer", "", nil, 0},
+		{"peer not in the allowlist", peerKey, map[string]bool{}, 0},
+		{"allowed peer", peerKey, map[string]bool{peerKey: true}, 2},
+		{"authenticated peer", peerKey, nil, 2},
+	}
+
+	for _, test := range tests {
+		resetMembers()
+		ctx.AllowedKeys = test.allowedKeys
+
+		client, server := net.Pipe()
+		conn := NewConn(server)
+		conn.SetPeerKey(test.peerKey)
+		onReceivingPeers(&ctx, &connectionData{name: "peer", conn: conn}, body)
+		client.Close()
+		server.Close()
+
+		// members without a key can not be dialed, so they are not kept
+		if len(members) != test.members || (test.members > 0 && isMember(shared[2])) {
+			t.Error(test.name, "expected", test.members, "members but got", len(members))
+		}
+	}
+}
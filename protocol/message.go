@@ -5,23 +5,31 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"net"
+	"fmt"
+	"time"
 )
 
 type MessageHeader string
 
 const (
 	// server api
-	PING      MessageHeader = "PING" // Just a PING message
-	PONG      MessageHeader = "PONG" // Just a PONG message
-	CONNECT   MessageHeader = "CONN" // Expects 2 arguments -> address and port
-	Q_CONNECT MessageHeader = "CON?" // Asks a node if he wants to connect
-	OK        MessageHeader = "R_OK"
-	NO        MessageHeader = "R_NO"
-	ERR       MessageHeader = "R_ER"
-	MSGS      MessageHeader = "MSGS"
-	NEEDS     MessageHeader = "NEED"
-	HEADS     MessageHeader = "HEDS"
+	PING       MessageHeader = "PING" // Just a PING message
+	PONG       MessageHeader = "PONG" // Just a PONG message
+	CONNECT    MessageHeader = "CONN" // Expects 2 arguments -> address and port
+	Q_CONNECT  MessageHeader = "CON?" // Asks a node if he wants to connect
+	OK         MessageHeader = "R_OK"
+	NO         MessageHeader = "R_NO"
+	ERR        MessageHeader = "R_ER"
+	MSGS       MessageHeader = "MSGS"
+	NEEDS      MessageHeader = "NEED"
+	HEADS      MessageHeader = "HEDS"
+	GOODBYE    MessageHeader = "GBYE" // The node is shutting down
+	PEERS      MessageHeader = "PEER" // Shares known nodes with a peer
+	AUTH       MessageHeader = "AUTH" // Proves the key of the dialer in the handshake
+	DIGEST     MessageHeader = "DGST" // Compares the heads of a range of keys
+	SKETCH     MessageHeader = "SKCH" // Compares the operations of a key as a set
+	Q_SNAPSHOT MessageHeader = "SNP?" // Asks for a chunk of a snapshot of a range of keys
+	SNAPSHOT   MessageHeader = "SNAP" // A chunk of a snapshot
 
 	// user api
 	API_NEW MessageHeader = "/new" // Adds a new key to the database, expects a type
@@ -30,6 +38,10 @@ const (
 	API_DEC MessageHeader = "/dec" // Decrements a value in the database
 	API_ADD MessageHeader = "/add" // Adds a value to the database
 	API_RMV MessageHeader = "/rmv" // Removes a value from the database
+	API_HST MessageHeader = "/hst" // Lists the operations of a key in topological order
+	API_LST MessageHeader = "/lst" // Lists the keys in the database
+	API_ALS MessageHeader = "/als" // Claims a human-readable alias for a key
+	API_BAT MessageHeader = "/bat" // Applies several operations, on any keys, atomically
 )
 
 var EMPTYBODY struct{} = struct{}{}
@@ -79,35 +91,57 @@ func (msg Message) IsMalformed() bool {
 	return msg.malformed != nil
 }
 
-func (msg Message) Send(conn net.Conn) (e error) {
+func (msg Message) Send(conn *Conn) (e error) {
 	if msg.IsMalformed() {
 		return msg.malformed
 	}
 
-	_, e = conn.Write(msgToProtocolMsg(msg))
+	payload, e := msgToProtocolMsg(msg, conn.framing)
+	if e != nil {
+		return e
+	}
+
+	if conn.writeTimeout > 0 {
+		if e := conn.SetWriteDeadline(time.Now().Add(conn.writeTimeout)); e != nil {
+			return e
+		}
+	}
+	_, e = conn.Write(payload)
 
 	return e
 }
 
-func (msg Message) SendAwaitRead(conn net.Conn) (data []byte, e error) {
+func (msg Message) SendAwaitRead(conn *Conn) (data []byte, e error) {
 	if e := msg.Send(conn); e != nil {
 		return nil, e
 	}
 
-	return ReadFromConnection(conn)
+	data, _, e = ReadFromConnection(conn)
+	return data, e
 }
 
 type ProtocolMessage []byte
 
-func msgToProtocolMsg(msg Message) []byte {
-	var payload []byte = []byte(msg.header)
-
-	sizebytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(sizebytes, uint16(len(msg.content)))
-
-	payload = append(payload, sizebytes[0]) // left byte
-	payload = append(payload, sizebytes[1]) // right byte
-	payload = append(payload, msg.content...)
+func msgToProtocolMsg(msg Message, framing FrameVersion) ([]byte, error) {
+	var payload []byte = make([]byte, 0)
+
+	switch framing {
+	case FRAME_V2:
+		if len(msg.content) > MAX_MESSAGE_SIZE {
+			return nil, errors.New(fmt.Sprint("Message of ", len(msg.content), " bytes exceeds the maximum size"))
+		}
+
+		payload = append(payload, _FRAME_V2_MARKER)
+		payload = append(payload, []byte(msg.header)...)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(msg.content)))
+	default:
+		if len(msg.content) > _MAX_V1_MESSAGE_SIZE {
+			return nil, errors.New(fmt.Sprint("Message of ", len(msg.content), " bytes does not fit the legacy framing"))
+		}
+
+		payload = append(payload, []byte(msg.header)...)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(msg.content)))
+	}
 
-	return payload
+	return append(payload, msg.content...), nil
 }
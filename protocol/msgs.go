@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bftkvstore/crdts"
+	"bftkvstore/logger"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// Operations are kept as the raw signed bytes (in a string so they can be put
+// in sets). Peers that negotiated raw operations get MSGS as
+//
+//	flags (1) | groups (4) | per group: key length (2), key, count (4)
+//	and per operation: length (4), signed operation
+//
+// where the batch flag marks the groups as a batch, other peers get the JSON
+// msgsDTO with the operations hex encoded
+const _MSGS_FLAG_BATCH byte = 0x01
+
+var errMalformedMsgs = errors.New("Malformed binary MSGS message")
+
+func hashOf(op string) string {
+	return crdts.HashOperation(crdts.SignedOperation(op))
+}
+
+func newMsgsMessage(data msgsDTO, rawOps bool) Message {
+	if !rawOps {
+		return NewMessage(MSGS).AddContent(hexMsgs(data))
+	}
+
+	groups := []msgsDTO{data}
+	var flags byte = 0
+	if len(data.Batch) > 0 {
+		groups = data.Batch
+		flags |= _MSGS_FLAG_BATCH
+	}
+
+	content := []byte{flags}
+	content = binary.BigEndian.AppendUint32(content, uint32(len(groups)))
+	for _, group := range groups {
+		content = binary.BigEndian.AppendUint16(content, uint16(len(group.Key)))
+		content = append(content, group.Key...)
+		content = binary.BigEndian.AppendUint32(content, uint32(len(group.Messages)))
+		for _, op := range group.Messages {
+			content = binary.BigEndian.AppendUint32(content, uint32(len(op)))
+			content = append(content, op...)
+		}
+	}
+
+	msg := NewMessage(MSGS)
+	msg.content = content
+	return msg
+}
+
+func hexMsgs(data msgsDTO) msgsDTO {
+	encoded := msgsDTO{
+		Key:      data.Key,
+		Messages: make([]string, len(data.Messages)),
+	}
+	for idx, op := range data.Messages {
+		encoded.Messages[idx] = hex.EncodeToString([]byte(op))
+	}
+	for _, group := range data.Batch {
+		encoded.Batch = append(encoded.Batch, hexMsgs(group))
+	}
+	return encoded
+}
+
+// Reads a MSGS body in either encoding, operations that can not be decoded
+// are dropped
+func readMsgs(body []byte, rawOps bool) (data msgsDTO, err error) {
+	if !rawOps {
+		data, err = unmarshallJson[msgsDTO](body)
+		if err != nil {
+			return data, err
+		}
+		return unhexMsgs(data), nil
+	}
+
+	if len(body) < 5 {
+		return data, errMalformedMsgs
+	}
+	flags := body[0]
+	count := binary.BigEndian.Uint32(body[1:5])
+	body = body[5:]
+
+	groups := make([]msgsDTO, 0)
+	for range count {
+		var group msgsDTO
+		if group, body, err = readMsgsGroup(body); err != nil {
+			return data, err
+		}
+		groups = append(groups, group)
+	}
+	if len(body) != 0 {
+		return data, errMalformedMsgs
+	}
+
+	if flags&_MSGS_FLAG_BATCH != 0 {
+		return msgsDTO{Messages: make([]string, 0), Batch: groups}, nil
+	}
+	if len(groups) != 1 {
+		return data, errMalformedMsgs
+	}
+	return groups[0], nil
+}
+
+func readMsgsGroup(body []byte) (group msgsDTO, rest []byte, err error) {
+	next := func(n int) ([]byte, error) {
+		if len(body) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		read := body[:n]
+		body = body[n:]
+		return read, nil
+	}
+
+	keyLen, err := next(2)
+	if err != nil {
+		return group, nil, errMalformedMsgs
+	}
+	key, err := next(int(binary.BigEndian.Uint16(keyLen)))
+	if err != nil {
+		return group, nil, errMalformedMsgs
+	}
+	count, err := next(4)
+	if err != nil {
+		return group, nil, errMalformedMsgs
+	}
+
+	group.Key = string(key)
+	group.Messages = make([]string, 0)
+	for range binary.BigEndian.Uint32(count) {
+		opLen, err := next(4)
+		if err != nil {
+			return group, nil, errMalformedMsgs
+		}
+		op, err := next(int(binary.BigEndian.Uint32(opLen)))
+		if err != nil {
+			return group, nil, errMalformedMsgs
+		}
+		group.Messages = append(group.Messages, string(op))
+	}
+
+	return group, body, nil
+}
+
+func unhexMsgs(data msgsDTO) msgsDTO {
+	decoded := msgsDTO{
+		Key:      data.Key,
+		Messages: make([]string, 0),
+	}
+	for _, msg := range data.Messages {
+		op, err := hex.DecodeString(msg)
+		if err != nil {
+			logger.Alert("Failed decode the msgs operation", err)
+			continue
+		}
+		decoded.Messages = append(decoded.Messages, string(op))
+	}
+	for _, group := range data.Batch {
+		decoded.Batch = append(decoded.Batch, unhexMsgs(group))
+	}
+	return decoded
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/logger"
+	stdcontext "context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+const (
+	_REDIAL_MIN_DELAY = time.Second
+	_REDIAL_MAX_DELAY = 2 * time.Minute
+)
+
+var redialing map[string]bool = make(map[string]bool) // guarded by lockConnections
+
+// Dials the node, and retries with jittered exponential backoff, until a
+// connection to it exists, which is then served like any other peer. Only one
+// of these runs per node at a time.
+func KeepConnected(runCtx stdcontext.Context, ctx *context.AppContext, address string, port string, expectedKey ed25519.PublicKey) {
+	name := net.JoinHostPort(address, port)
+
+	lockConnections.Lock()
+	if redialing[name] {
+		lockConnections.Unlock()
+		return
+	}
+	redialing[name] = true
+	lockConnections.Unlock()
+
+	defer func() {
+		lockConnections.Lock()
+		delete(redialing, name)
+		lockConnections.Unlock()
+	}()
+
+	delay := _REDIAL_MIN_DELAY
+	for {
+		if isConnected(name, expectedKey) { // the node dialed us or was connected again by hand
+			return
+		}
+
+		conn, err := ConnectTo(runCtx, ctx, address, port, expectedKey)
+		if err == nil {
+			logger.Info("Connected to", name)
+			node := context.Node{Address: address, Port: port, Conn: conn, Dialed: true, Redial: true, ExpectedKey: expectedKey}
+			select {
+			case ctx.NewNodes <- node:
+			case <-runCtx.Done():
+				conn.Close()
+			}
+			return
+		}
+		logger.Alert("Failed to connect to", name, err)
+
+		// half of the delay is random so nodes that lost each other at the
+		// same time do not redial in lockstep
+		select {
+		case <-time.After(delay/2 + rand.N(delay/2)):
+		case <-runCtx.Done():
+			return
+		}
+		delay = min(2*delay, _REDIAL_MAX_DELAY)
+	}
+}
+
+func isConnected(name string, publicKey ed25519.PublicKey) bool {
+	lockConnections.Lock()
+	defer lockConnections.Unlock()
+
+	if _, connected := connections[hex.EncodeToString(publicKey)]; publicKey != nil && connected {
+		return true
+	}
+	for _, connData := range connections {
+		if connData.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -2,75 +2,254 @@ package protocol
 
 import (
 	"bftkvstore/context"
-	"bufio"
+	"bftkvstore/logger"
+	"bytes"
+	stdcontext "context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
 )
 
-const READER_SIZE = 1000
+// Reads the next message of the connection, blocking until all its bytes
+// arrived or the read timeout of the connection expires
+func ReadFromConnection(conn *Conn) (msg []byte, framing FrameVersion, err error) {
+	if conn.readTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(conn.readTimeout)); err != nil {
+			return nil, framing, err
+		}
+	}
 
-func ReadFromConnection(conn net.Conn) (msg []byte, err error) {
-	reader := bufio.NewReader(conn)
+	first, err := conn.reader.ReadByte()
+	if err != nil {
+		return nil, framing, err
+	}
 
-	headerAndSize := make([]byte, 6)
+	var contentSize int
+	if first == _FRAME_V2_MARKER {
+		framing = FRAME_V2
 
-	sz, err := reader.Read(headerAndSize)
-	if err != nil || sz != 6 {
-		return nil, err
-		// NOTE: Perhaps discard the buffer
+		headerAndSize := make([]byte, 8)
+		if _, err := io.ReadFull(conn.reader, headerAndSize); err != nil {
+			return nil, framing, err
+		}
+
+		msg = append(msg, headerAndSize[0:4]...)
+		contentSize = int(binary.BigEndian.Uint32(headerAndSize[4:]))
+	} else {
+		framing = FRAME_V1
+
+		headerAndSize := make([]byte, 5)
+		if _, err := io.ReadFull(conn.reader, headerAndSize); err != nil {
+			return nil, framing, err
+		}
+
+		msg = append(msg, first)
+		msg = append(msg, headerAndSize[0:3]...)
+		contentSize = int(binary.BigEndian.Uint16(headerAndSize[3:]))
 	}
 
-	msg = append(msg, headerAndSize[0:4]...)
+	// the stream can not be resynchronized after this, the caller should
+	// close the connection
+	if contentSize > MAX_MESSAGE_SIZE {
+		return nil, framing, errors.New(fmt.Sprint("Message of ", contentSize, " bytes exceeds the maximum size"))
+	}
 
-	contentSize := int(binary.BigEndian.Uint16(headerAndSize[4:]))
+	// the content is buffered as it arrives, so announcing a large message and
+	// sending nothing does not allocate it all
+	content := bytes.NewBuffer(msg)
+	if read, err := io.CopyN(content, conn.reader, int64(contentSize)); err != nil {
+		// like io.ReadFull, only a message cut in its content is unexpected
+		if err == io.EOF && read > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, framing, err
+	}
 
-	for contentSize > 0 {
-		data := make([]byte, min(READER_SIZE, contentSize))
+	return content.Bytes(), framing, nil
+}
 
-		sz, err := reader.Read(data)
-		contentSize -= sz
+// Serves requests from the connection, one after the other, until the client
+// closes it, the node shuts down or the connection is handed over to the
+// replication
+func handleConnection(runCtx stdcontext.Context, ctx *context.AppContext, conn *Conn, listener Listener) {
+	conn.SetReadTimeout(_CLIENT_READ_TIMEOUT)
+
+	// on shutdown the connection is closed as soon as the request being
+	// handled, if any, is answered
+	var busy sync.Mutex
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-runCtx.Done():
+			busy.Lock()
+			conn.Close()
+			busy.Unlock()
+		case <-finished:
+		}
+	}()
 
+	for {
+		payload, framing, err := ReadFromConnection(conn)
 		if err != nil {
-			return nil, err
+			if !isNetConnClosedErr(err) {
+				logger.Alert("Failed to read request", err)
+			}
+			break
 		}
+		conn.SetFraming(framing)
 
-		for i := range sz {
-			msg = append(msg, data[i])
+		msg, ok := MessageFromPayload(payload)
+		if !ok {
+			break
 		}
 
-		// Check if there is any more data to read
-		if reader.Buffered() == 0 {
-			break
+		busy.Lock()
+		handedOver := Router(runCtx, ctx, conn, msg, listener)
+		busy.Unlock()
+
+		if handedOver {
+			return
 		}
 	}
 
-	return msg, nil
+	if err := conn.Close(); err != nil && !isNetConnClosedErr(err) {
+		logger.Alert("Failed to close a connection", err)
+	}
 }
 
-func handleConnection(ctx *context.AppContext, conn net.Conn) {
-	payload, err := ReadFromConnection(conn)
+// A port the node listens on, for the replication between nodes, for the
+// user api or for both, or the unix socket for admin commands
+type Listener struct {
+	Address string // empty for every interface
+	Port    string
+	Socket  string // path of a unix socket, used instead of the address and port
+	TLS     TLSMode
+	Peers   bool
+	Clients bool
+	Admin   bool // admin commands are trusted without a signature
+}
+
+func (listener Listener) serves(header MessageHeader) bool {
+	return (listener.Peers && slices.Contains(peerHeaders, header)) ||
+		(listener.Clients && slices.Contains(clientHeaders, header)) ||
+		(listener.Admin && slices.Contains(adminHeaders, header))
+}
+
+func (listener Listener) listen() (net.Listener, error) {
+	if listener.Socket == "" {
+		return net.Listen("tcp", net.JoinHostPort(listener.Address, listener.Port))
+	}
+
+	// a node that did not shut down cleanly leaves the socket behind
+	if info, err := os.Lstat(listener.Socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", listener.Socket)
+		}
+		os.Remove(listener.Socket)
+	}
+
+	// the socket is created in a directory only the node can enter, and
+	// moved in place once only the node can connect to it
+	dir, err := os.MkdirTemp(filepath.Dir(listener.Socket), ".admin-")
 	if err != nil {
-		return
+		return nil, err
 	}
+	defer os.RemoveAll(dir)
 
-	msg, ok := MessageFromPayload(payload)
-	if ok {
-		Router(ctx, conn, msg)
+	created := filepath.Join(dir, filepath.Base(listener.Socket))
+	ln, err := net.Listen("unix", created)
+	if err != nil {
+		return nil, err
 	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err = os.Chmod(created, 0600); err == nil {
+		err = os.Rename(created, listener.Socket)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return socketListener{Listener: ln, path: listener.Socket}, nil
 }
 
-func ReceiverStart(ctx *context.AppContext, port string) {
-	ln, err := net.Listen("tcp", ":"+port)
+// A unix socket listener that removes its socket once closed
+type socketListener struct {
+	net.Listener
+	path string
+}
 
-	if err != nil {
-		// handle error
+func (ln socketListener) Close() error {
+	os.Remove(ln.path)
+	return ln.Listener.Close()
+}
+
+// Accepts connections on every listener until runCtx is done, then waits for
+// the requests being handled to be answered. Fails without serving if any of
+// them can not listen.
+func ReceiverStart(runCtx stdcontext.Context, ctx *context.AppContext, listeners ...Listener) error {
+	lns := make([]net.Listener, 0, len(listeners))
+	for _, listener := range listeners {
+		ln, err := listener.listen()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
 	}
+
+	go func() {
+		<-runCtx.Done()
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}()
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+
+	for idx, ln := range lns {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			acceptConnections(runCtx, ctx, ln, listeners[idx], &handlers)
+		}()
+	}
+
+	return nil
+}
+
+func acceptConnections(runCtx stdcontext.Context, ctx *context.AppContext, ln net.Listener, listener Listener, handlers *sync.WaitGroup) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			// handle error
+			if runCtx.Err() != nil {
+				return
+			}
+			logger.Alert("Failed to accept a connection", err)
 			continue
 		}
-		go handleConnection(ctx, conn)
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			tlsConn, err := acceptTLS(runCtx, conn, listener.TLS)
+			if err != nil {
+				logger.Alert("Failed to start the connection", err)
+				conn.Close()
+				return
+			}
+			handleConnection(runCtx, ctx, tlsConn, listener)
+		}()
 	}
 }
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestReadFromConnectionAnnouncedSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// announces the largest message but sends a few bytes of it
+	go func() {
+		frame := append([]byte{_FRAME_V2_MARKER}, "MSGS"...)
+		frame = binary.BigEndian.AppendUint32(frame, MAX_MESSAGE_SIZE)
+		client.Write(append(frame, "partial"...))
+		client.Close()
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := ReadFromConnection(NewConn(server))
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("Expected the cut message to fail but got", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > MAX_MESSAGE_SIZE/16 {
+		t.Error("Expected the content to be allocated as it arrives but allocated", allocated, "bytes")
+	}
+}
@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/crdts"
+	"bftkvstore/logger"
+	"bftkvstore/set"
+	"bftkvstore/utils"
+	"encoding/hex"
+	"slices"
+	"sync"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+// Algorithm 2 of the reconciliation: along with the heads of a key, a node
+// sends the heads the peer had the last time all of them were known here
+// (oldHeads) and a Bloom filter of the operations added since then. The peer
+// pushes the operations since oldHeads that are not in the filter, and their
+// successors, which the node is certain to be missing, instead of waiting to
+// be asked for them one NEED round-trip at a time. Operations missed because
+// of false positives are still found through the heads.
+const (
+	_BLOOM_FALSE_POSITIVE_RATE = 0.01
+	_BLOOM_MAX_HASHES          = 32 // filters asking for more are ignored
+)
+
+type headsDTO struct {
+	Key      string             `json:"key"`
+	Messages []string           `json:"messages"`           // hashes of the heads
+	OldHeads []string           `json:"oldHeads,omitempty"` // heads of the peer at the last reconciliation
+	Filter   *bloom.BloomFilter `json:"filter,omitempty"`   // hashes of the operations since oldHeads
+}
+
+var lockOldHeads sync.Mutex
+var oldHeads = make(map[string]map[string][]string) // peer id -> key -> hashes, kept across reconnections
+
+func newHeadsMessage(ctx *context.AppContext, connData *connectionData, key string, heads []string) Message {
+	data := headsDTO{Key: key, Messages: heads}
+
+	lockOldHeads.Lock()
+	old, exists := oldHeads[connData.id][key]
+	lockOldHeads.Unlock()
+
+	if exists {
+		if since, known := messagesSince(keyOperations(ctx, key), old); known {
+			data.OldHeads = old
+			data.Filter = bloom.NewWithEstimates(uint(max(len(since), 1)), _BLOOM_FALSE_POSITIVE_RATE)
+			for _, op := range since {
+				data.Filter.Add(hashBytes(hashOf(op)))
+			}
+		}
+	}
+
+	return NewMessage(HEADS).AddContent(data)
+}
+
+// Remembers the heads of the peer once every one of them is known here
+func setOldHeads(connData *connectionData, key string, heads []string) {
+	lockOldHeads.Lock()
+	defer lockOldHeads.Unlock()
+
+	if oldHeads[connData.id] == nil {
+		oldHeads[connData.id] = make(map[string][]string)
+	}
+	oldHeads[connData.id][key] = slices.Clone(heads)
+}
+
+// Sends the operations of the key that the filter of the peer shows it does
+// not have
+func pushLikelyMissing(ctx *context.AppContext, connData *connectionData, data headsDTO) {
+	filter := data.Filter
+	if filter.Cap() == 0 || filter.K() == 0 || filter.K() > _BLOOM_MAX_HASHES || filter.BitSet().Len() < filter.Cap() {
+		logger.Alert("Ignoring a malformed Bloom filter from", connData.name)
+		return
+	}
+
+	// the peer may know operations this node lost, then the filter is useless
+	since, known := messagesSince(keyOperations(ctx, data.Key), data.OldHeads)
+	if !known {
+		return
+	}
+
+	absent := make(map[string]bool)
+	for _, op := range since {
+		if hash := hashOf(op); !filter.Test(hashBytes(hash)) {
+			absent[hash] = true
+		}
+	}
+	if len(absent) == 0 {
+		return
+	}
+
+	push := set.New[string]()
+	for _, op := range withSuccessors(since, absent) {
+		if !set.Has(connData.vars.sent, op) {
+			push = set.Add(push, op)
+		}
+	}
+	if len(push) == 0 {
+		return
+	}
+
+	logger.Debug("Pushing", len(push), "operations of", data.Key, "to", connData.name)
+	connData.vars.sent = set.Union(connData.vars.sent, push)
+	newMsgsMessage(msgsDTO{Key: data.Key, Messages: push}, connData.conn.RawOps()).Send(connData.conn)
+}
+
+// Returns the operations that are not in the causal past of the heads (heads
+// included), known is false when some of them is not among the operations
+func messagesSince(ops []string, heads []string) (since []string, known bool) {
+	byHash := make(map[string]string, len(ops))
+	for _, op := range ops {
+		byHash[hashOf(op)] = op
+	}
+
+	past := make(map[string]bool)
+	queue := slices.Clone(heads)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		if past[hash] {
+			continue
+		}
+		op, exists := byHash[hash]
+		if !exists {
+			return nil, false
+		}
+		past[hash] = true
+
+		parsed, err := crdts.ReadOperation(crdts.SignedOperation(op))
+		if err != nil {
+			continue
+		}
+		queue = append(queue, parsed.Preds...)
+	}
+
+	since = make([]string, 0)
+	for hash, op := range byHash {
+		if !past[hash] {
+			since = append(since, op)
+		}
+	}
+	return since, true
+}
+
+// Returns the operations with one of the given hashes and every operation
+// that depends on them, in topological order
+func withSuccessors(ops []string, roots map[string]bool) []string {
+	included := make(map[string]bool)
+	result := make([]string, 0)
+
+	for _, signedOp := range crdts.CalculateOperationsTopologicalOrder(toSignedOperations(ops)) {
+		hash := crdts.HashOperation(signedOp)
+		include := roots[hash]
+
+		if op, err := crdts.ReadOperation(signedOp); !include && err == nil {
+			include = slices.ContainsFunc(op.Preds, func(pred string) bool { return included[pred] })
+		}
+		if include {
+			included[hash] = true
+			result = append(result, string(signedOp))
+		}
+	}
+
+	return result
+}
+
+func keyOperations(ctx *context.AppContext, key string) []string {
+	ops, err := ctx.Storage.GetOperations(key)
+	if err != nil {
+		return nil
+	}
+	return utils.Map(ops, func(op crdts.SignedOperation) string { return string(op) })
+}
+
+func hashBytes(hash string) []byte {
+	decoded, _ := hex.DecodeString(hash)
+	return decoded
+}
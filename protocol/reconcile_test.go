@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/crdts"
+	"bftkvstore/set"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+// op0 <- op1 <- op2 and op0 <- op3, then op4 merges op2 and op3
+func newReconcileTestOperations(t *testing.T) (key string, ops []string) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+
+	op0, _, err := crdts.NewCounterOp(secretkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op1, _ := crdts.IncCounterOp(secretkey, 1, []crdts.SignedOperation{op0})
+	op2, _ := crdts.IncCounterOp(secretkey, 2, []crdts.SignedOperation{op1})
+	op3, _ := crdts.IncCounterOp(secretkey, 3, []crdts.SignedOperation{op0})
+	op4, _ := crdts.IncCounterOp(secretkey, 4, []crdts.SignedOperation{op2, op3})
+
+	for _, op := range [][]byte{op0, op1, op2, op3, op4} {
+		ops = append(ops, string(op))
+	}
+	return crdts.HashOperation(op0), ops
+}
+
+func hashesOf(ops []string) string {
+	hashes := make([]string, 0, len(ops))
+	for _, op := range ops {
+		hashes = append(hashes, hashOf(op))
+	}
+	slices.Sort(hashes)
+	return fmt.Sprint(hashes)
+}
+
+func TestMessagesSince(t *testing.T) {
+	_, ops := newReconcileTestOperations(t)
+
+	tests := []struct {
+		name  string
+		heads []string
+		since []string
+		known bool
+	}{
+		{"no heads", []string{}, ops, true},
+		{"one branch", []string{hashOf(ops[2])}, []string{ops[3], ops[4]}, true},
+		{"both branches", []string{hashOf(ops[1]), hashOf(ops[3])}, []string{ops[2], ops[4]}, true},
+		{"latest", []string{hashOf(ops[4])}, []string{}, true},
+		{"unknown head", []string{hashOf(ops[1]), "00"}, nil, false},
+	}
+
+	for _, test := range tests {
+		since, known := messagesSince(ops, test.heads)
+		if known != test.known || (known && hashesOf(since) != hashesOf(test.since)) {
+			t.Error(test.name, "expected", hashesOf(test.since), test.known, "but got", hashesOf(since), known)
+		}
+	}
+}
+
+func TestPushLikelyMissing(t *testing.T) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	ctx := context.New(secretkey, "127.0.0.1", "8089")
+	key, ops := newReconcileTestOperations(t)
+	if err := ctx.Storage.Assign(key, crdts.SignedOperation(ops[0])); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops[1:] {
+		if err := ctx.Storage.Append(key, crdts.SignedOperation(op)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the peer had op1 and then received op3, so it misses op2 and op4. The
+	// filters are large enough for false positives to never happen.
+	filterOf := func(ops ...string) *bloom.BloomFilter {
+		filter := bloom.NewWithEstimates(1000, 1e-9)
+		for _, op := range ops {
+			filter.Add(hashBytes(hashOf(op)))
+		}
+		return filter
+	}
+
+	tests := []struct {
+		name   string
+		data   headsDTO
+		pushed []string
+	}{
+		{"missing operations and successors", headsDTO{Key: key, OldHeads: []string{hashOf(ops[1])}, Filter: filterOf(ops[3])}, []string{ops[2], ops[4]}},
+		{"nothing missing", headsDTO{Key: key, OldHeads: []string{hashOf(ops[1])}, Filter: filterOf(ops[2], ops[3], ops[4])}, []string{}},
+		{"unknown old heads", headsDTO{Key: key, OldHeads: []string{"00"}, Filter: filterOf(ops[3])}, []string{}},
+		{"malformed filter", headsDTO{Key: key, OldHeads: []string{hashOf(ops[1])}, Filter: bloom.From(make([]uint64, 1), _BLOOM_MAX_HASHES+1)}, []string{}},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		connData := &connectionData{name: "peer", conn: NewConn(server), vars: &connectionVariables{sent: set.New[string]()}}
+
+		pushed := make(chan msgsDTO, 1)
+		go func() {
+			payload, _, err := ReadFromConnection(NewConn(client))
+			msg, ok := MessageFromPayload(payload)
+			if err != nil || !ok || msg.header != MSGS {
+				close(pushed)
+				return
+			}
+			data, _ := readMsgs(msg.content, false)
+			pushed <- data
+		}()
+
+		pushLikelyMissing(&ctx, connData, test.data)
+		server.Close()
+
+		data := <-pushed
+		client.Close()
+		if hashesOf(data.Messages) != hashesOf(test.pushed) || hashesOf(connData.vars.sent) != hashesOf(test.pushed) {
+			t.Error(test.name, "expected to push", hashesOf(test.pushed), "but pushed", hashesOf(data.Messages))
+		}
+	}
+}
@@ -2,21 +2,31 @@ package protocol
 
 import (
 	"bftkvstore/context"
-	"bftkvstore/logger"
-	"net"
+	stdcontext "context"
+	"fmt"
 )
 
-func Router(ctx *context.AppContext, conn net.Conn, msg Message) {
-	closeConnection := true
+var peerHeaders = []MessageHeader{PING, CONNECT, Q_CONNECT}
+var adminHeaders = []MessageHeader{PING, CONNECT}
+var clientHeaders = []MessageHeader{API_NEW, API_GET, API_INC, API_DEC, API_ADD, API_RMV, API_HST, API_LST, API_ALS, API_BAT}
+
+// Handles a request, returns true when the connection was handed over to the
+// replication and must no longer be used by the caller. Only the headers the
+// listener serves are routed.
+func Router(runCtx stdcontext.Context, ctx *context.AppContext, conn *Conn, msg Message, listener Listener) (handedOver bool) {
+	if !listener.serves(msg.header) {
+		NewErrorMessage(ERR_UNKNOWN_HEADER, fmt.Sprint("Unknown header ", msg.header), nil).Send(conn)
+		return false
+	}
 
 	switch msg.header {
 	// server api
 	case PING:
 		pingMsg(conn)
 	case CONNECT:
-		connectMsg(ctx, conn, msg.content)
+		connectMsg(runCtx, ctx, conn, msg.content, listener.Admin)
 	case Q_CONNECT:
-		closeConnection = !qConnectMsg(ctx, conn, msg.content)
+		handedOver = qConnectMsg(ctx, conn, msg.content)
 
 	// user api
 	case API_NEW:
@@ -25,12 +35,17 @@ func Router(ctx *context.AppContext, conn net.Conn, msg Message) {
 		readMsg(ctx, conn, msg.content)
 	case API_INC, API_DEC, API_ADD, API_RMV:
 		opMsg(msg.header, ctx, conn, msg.content)
+	case API_HST:
+		histMsg(ctx, conn, msg.content)
+	case API_LST:
+		listMsg(ctx, conn, msg.content)
+	case API_ALS:
+		aliasMsg(ctx, conn, msg.content)
+	case API_BAT:
+		batchMsg(ctx, conn, msg.content)
 	default:
+		NewErrorMessage(ERR_UNKNOWN_HEADER, fmt.Sprint("Unknown header ", msg.header), nil).Send(conn)
 	}
 
-	if closeConnection {
-		if err := conn.Close(); err != nil {
-			logger.Alert("Failed to close a connection", err)
-		}
-	}
+	return handedOver
 }
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	stdcontext "context"
+	"testing"
+)
+
+func TestListenerServes(t *testing.T) {
+	peers := Listener{Peers: true}
+	clients := Listener{Clients: true}
+	both := Listener{Peers: true, Clients: true}
+	admin := Listener{Socket: ADMIN_SOCKET, Admin: true}
+
+	tests := []struct {
+		name     string
+		listener Listener
+		header   MessageHeader
+		served   bool
+	}{
+		{"handshake on the peer port", peers, Q_CONNECT, true},
+		{"signed connect on the peer port", peers, CONNECT, true},
+		{"user api on the peer port", peers, API_GET, false},
+		{"batch on the peer port", peers, API_BAT, false},
+		{"handshake on the client port", clients, Q_CONNECT, false},
+		{"connect on the client port", clients, CONNECT, false},
+		{"user api on the client port", clients, API_GET, true},
+		{"ping on the client port", clients, PING, false},
+		{"handshake on a shared port", both, Q_CONNECT, true},
+		{"user api on a shared port", both, API_HST, true},
+		{"connect on the admin socket", admin, CONNECT, true},
+		{"handshake on the admin socket", admin, Q_CONNECT, false},
+		{"user api on the admin socket", admin, API_NEW, false},
+		{"replication outside the handshake", both, HEADS, false},
+		{"unknown header", both, "XXXX", false},
+	}
+
+	for _, test := range tests {
+		if served := test.listener.serves(test.header); served != test.served {
+			t.Error(test.name, "should be served:", test.served)
+		}
+	}
+}
+
+func TestRouterRefusesUnservedHeaders(t *testing.T) {
+	ctx := newHandshakeTestContext()
+
+	reply := requestHandler(t, func(conn *Conn, body []byte) {
+		Router(stdcontext.Background(), &ctx, conn, Message{header: API_LST, content: body}, Listener{Peers: true})
+	}, `{}`)
+	if reply.header != ERR {
+		t.Fatal("Expected the user api to be refused on the peer port but got", string(reply.header))
+	}
+	if reason, err := unmarshallJson[errorDTO](reply.content); err != nil || reason.Code != ERR_UNKNOWN_HEADER {
+		t.Error("Expected an unknown header error but got", string(reply.content))
+	}
+}
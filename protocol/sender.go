@@ -1,33 +1,138 @@
 package protocol
 
 import (
+	"bftkvstore/context"
+	"bftkvstore/logger"
+	stdcontext "context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
 )
 
-func ConnectTo(ownAddress string, ownPort string, targetAddress string, targetPort string) (conn net.Conn, ok bool) {
-	conn, err := net.Dial("tcp", targetAddress+":"+targetPort)
+type connectHandshakeDTO struct {
+	Address   string       `json:"address"`
+	Port      string       `json:"port"`
+	Framing   FrameVersion `json:"framing,omitempty"`   // highest framing supported
+	RawOps    bool         `json:"rawOps,omitempty"`    // operations are exchanged as raw bytes
+	Digests   bool         `json:"digests,omitempty"`   // heads are compared through range digests
+	Sketches  bool         `json:"sketches,omitempty"`  // operations are compared through sketches
+	Snapshots bool         `json:"snapshots,omitempty"` // snapshots of ranges of keys are served
+	PublicKey string       `json:"publicKey,omitempty"` // hex encoded key of the node
+	Nonce     string       `json:"nonce,omitempty"`     // challenge for the other node
+	Signature string       `json:"signature,omitempty"` // the responder's proof of its key
+}
+
+// Connects to another node, when expectedKey is not nil the node must prove
+// it has that public key
+func ConnectTo(runCtx stdcontext.Context, ctx *context.AppContext, targetAddress string, targetPort string, expectedKey ed25519.PublicKey) (conn *Conn, err error) {
+	conn, err = dialWithTLS(runCtx, net.JoinHostPort(targetAddress, targetPort), expectedKey != nil)
 	if err != nil {
-		ok = false
-		return
+		return nil, err
 	}
+	conn.SetReadTimeout(_CLIENT_READ_TIMEOUT)
 
-	res, err := NewMessage(Q_CONNECT).AddContent(struct {
-		Address string `json:"address"`
-		Port    string `json:"port"`
-	}{ownAddress, ownPort}).SendAwaitRead(conn)
-	if err != nil {
+	if err := connectHandshake(ctx, conn, expectedKey); err != nil {
 		conn.Close()
-		ok = false
-		return
+		return nil, err
 	}
 
-	msg_parsed, ok := MessageFromPayload(res)
-	if ok && msg_parsed.header == OK {
-		return conn, true
-	} else {
-		conn.Close()
-		ok = false
-		return
+	conn.SetReadTimeout(_PEER_READ_TIMEOUT)
+	conn.SetWriteTimeout(_PEER_WRITE_TIMEOUT)
+	return conn, nil
+}
+
+func connectHandshake(ctx *context.AppContext, conn *Conn, expectedKey ed25519.PublicKey) error {
+	transcript := handshakeTranscript{DialerKey: ownPublicKey(ctx)}
+
+	var err error
+	if transcript.DialerNonce, err = newHandshakeNonce(); err != nil {
+		return err
+	}
+
+	res, err := NewMessage(Q_CONNECT).AddContent(connectHandshakeDTO{
+		Address:   ctx.Address,
+		Port:      ctx.Port,
+		Framing:   MAX_FRAME_VERSION,
+		RawOps:    true,
+		Digests:   true,
+		Sketches:  true,
+		Snapshots: true,
+		PublicKey: transcript.DialerKey,
+		Nonce:     transcript.DialerNonce,
+	}).SendAwaitRead(conn)
+	if err != nil {
+		return err
+	}
+	if err := refusal(res); err != nil {
+		return err
+	}
+
+	// older nodes answer without content, keep the legacy framing and do
+	// not authenticate, they are only taken when explicitly allowed
+	msg, _ := MessageFromPayload(res)
+	accepted, err := unmarshallJson[connectHandshakeDTO](msg.content)
+	if err == nil {
+		conn.SetFraming(accepted.Framing)
+		conn.SetRawOps(accepted.RawOps)
+		conn.SetDigests(accepted.Digests)
+		conn.SetSketches(accepted.Sketches)
+		conn.SetSnapshots(accepted.Snapshots)
+	}
+	if accepted.Signature == "" {
+		if !ctx.AllowUnauthenticated || expectedKey != nil || ctx.AllowedKeys != nil {
+			return errUnauthenticated
+		}
+		logger.Alert("The node does not authenticate, its key is unknown")
+		return nil
 	}
 
+	transcript.ResponderKey = accepted.PublicKey
+	transcript.ResponderNonce = accepted.Nonce
+	if err := transcript.verify(_HANDSHAKE_RESPONDER, accepted.PublicKey, accepted.Signature); err != nil {
+		return err
+	}
+	if accepted.PublicKey == transcript.DialerKey {
+		return errors.New("The node is this node itself")
+	}
+	if conn.tlsKey != "" && accepted.PublicKey != conn.tlsKey {
+		return errors.New("The key of the node is not the key of its certificate")
+	}
+	if expectedKey != nil && accepted.PublicKey != hex.EncodeToString(expectedKey) {
+		return errors.New(fmt.Sprint("The node identified itself with the key '", accepted.PublicKey, "' instead of the expected one"))
+	}
+	if !isAllowedKey(ctx, accepted.PublicKey) {
+		return errors.New(fmt.Sprint("The key '", accepted.PublicKey, "' of the node is not allowed"))
+	}
+
+	signature, err := transcript.sign(ctx, _HANDSHAKE_DIALER)
+	if err != nil {
+		return err
+	}
+	res, err = NewMessage(AUTH).AddContent(authDTO{Signature: signature}).SendAwaitRead(conn)
+	if err != nil {
+		return err
+	}
+	if err := refusal(res); err != nil {
+		return err
+	}
+
+	conn.SetPeerKey(accepted.PublicKey)
+	return nil
+}
+
+// Returns an error unless the response is R_OK
+func refusal(res []byte) error {
+	msg, ok := MessageFromPayload(res)
+	if ok && msg.header == OK {
+		return nil
+	}
+
+	if ok {
+		if reason, err := unmarshallJson[errorDTO](msg.content); err == nil {
+			return errors.New(fmt.Sprint("The node refused the connection: ", reason.Message))
+		}
+	}
+	return errors.New("The node refused the connection")
 }
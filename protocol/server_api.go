@@ -3,59 +3,162 @@ package protocol
 import (
 	"bftkvstore/context"
 	"bftkvstore/logger"
+	stdcontext "context"
 	"fmt"
-	"net"
 )
 
-func pingMsg(conn net.Conn) {
+func pingMsg(conn *Conn) {
 	NewMessage(PONG).Send(conn)
 }
 
-func connectMsg(ctx *context.AppContext, conn net.Conn, body []byte) {
+// Trusted connections come from the admin socket, others must be signed by
+// an operator
+func connectMsg(runCtx stdcontext.Context, ctx *context.AppContext, conn *Conn, body []byte, trusted bool) {
 	type connectMsgBody struct {
 		Address string `json:"address"`
 		Port    string `json:"port"`
+		operatorSignatureDTO
 	}
 
 	data, err := unmarshallJson[connectMsgBody](body)
 	if err != nil {
 		logger.Error("Error parsing connect message", err.Error())
-		NewMessage(ERR).Send(conn)
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with an address and a port", nil).Send(conn)
 		return
 	}
 
 	if data.Address == "" || data.Port == "" {
-		NewMessage(ERR).Send(conn)
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with an address and a port", nil).Send(conn)
 		return
 	}
 
-	serverConn, connected := ConnectTo(ctx.Address, ctx.Port, data.Address, data.Port)
+	if !trusted {
+		if err := checkOperator(ctx, CONNECT, data.operatorSignatureDTO, data.Address, data.Port); err != nil {
+			logger.Alert(fmt.Sprintf("Refused to connect to %s:%s for %s", data.Address, data.Port, conn.RemoteAddr()), err)
+			NewErrorMessage(ERR_NOT_ALLOWED, err.Error(), nil).Send(conn)
+			return
+		}
+		logger.Info(fmt.Sprintf("The operator %s asked to connect to %s:%s", data.Operator, data.Address, data.Port))
+	}
+
+	serverConn, err := ConnectTo(runCtx, ctx, data.Address, data.Port, nil)
 
-	if connected {
+	if err == nil {
 		logger.Info(fmt.Sprintf("Connected to %s:%s", data.Address, data.Port))
 		NewMessage(OK).Send(conn)
-		ctx.AddNewNode(data.Address, data.Port, serverConn)
+		ctx.AddNewNode(data.Address, data.Port, serverConn, true)
 	} else {
-		logger.Alert(fmt.Sprintf("Failed to connect to %s:%s", data.Address, data.Port))
-		NewMessage(NO).Send(conn)
+		logger.Alert(fmt.Sprintf("Failed to connect to %s:%s", data.Address, data.Port), err)
+		NewErrorMessage(ERR_CONNECTION_FAILED, err.Error(), nil).Send(conn)
 	}
 }
 
-func qConnectMsg(ctx *context.AppContext, conn net.Conn, body []byte) (ok bool) {
-	type connectMsgBody struct {
-		Address string `json:"address"`
-		Port    string `json:"port"`
-	}
-
-	data, err := unmarshallJson[connectMsgBody](body)
+func qConnectMsg(ctx *context.AppContext, conn *Conn, body []byte) (ok bool) {
+	data, err := unmarshallJson[connectHandshakeDTO](body)
 	if err != nil {
 		logger.Error("parsing connect message", err)
-		NewMessage(NO).Send(conn)
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with an address and a port", nil).Send(conn)
+		return false
+	}
+
+	if data.Address == "" || data.Port == "" {
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with an address and a port", nil).Send(conn)
 		return false
 	}
 
 	logger.Info(fmt.Sprintf("Received request to connect from %s:%s", data.Address, data.Port))
-	ctx.AddNewNode(data.Address, data.Port, conn)
+	framing := min(max(data.Framing, FRAME_V1), MAX_FRAME_VERSION)
+	reply := connectHandshakeDTO{
+		Address:   ctx.Address,
+		Port:      ctx.Port,
+		Framing:   framing,
+		RawOps:    data.RawOps,
+		Digests:   data.Digests,
+		Sketches:  data.Sketches,
+		Snapshots: data.Snapshots,
+		PublicKey: ownPublicKey(ctx),
+	}
+
+	// older nodes do not authenticate, so their key is unknown, they are only
+	// taken when explicitly allowed
+	if data.Nonce == "" {
+		if !ctx.AllowUnauthenticated || ctx.AllowedKeys != nil {
+			logger.Alert(fmt.Sprintf("Refused the node %s:%s that does not authenticate", data.Address, data.Port))
+			NewErrorMessage(ERR_UNAUTHENTICATED, "Nodes must prove their key to connect", nil).Send(conn)
+			return false
+		}
+		logger.Alert(fmt.Sprintf("The node %s:%s does not authenticate", data.Address, data.Port))
+		data.PublicKey = ""
+		NewMessage(OK).AddContent(reply).Send(conn)
+	} else if !acceptHandshake(ctx, conn, data, &reply) {
+		return false
+	}
+
+	conn.SetFraming(framing)
+	conn.SetRawOps(data.RawOps)
+	conn.SetDigests(data.Digests)
+	conn.SetSketches(data.Sketches)
+	conn.SetSnapshots(data.Snapshots)
+	conn.SetPeerKey(data.PublicKey)
+	conn.SetReadTimeout(_PEER_READ_TIMEOUT)
+	conn.SetWriteTimeout(_PEER_WRITE_TIMEOUT)
+
+	ctx.AddNewNode(data.Address, data.Port, conn, false)
+	return true
+}
+
+// Answers the challenge of the dialer with one of its own, the reply is sent
+// once the dialer proved its key
+func acceptHandshake(ctx *context.AppContext, conn *Conn, data connectHandshakeDTO, reply *connectHandshakeDTO) bool {
+	if !isAllowedKey(ctx, data.PublicKey) {
+		logger.Alert(fmt.Sprintf("Refused the node %s:%s with the key %s", data.Address, data.Port, data.PublicKey))
+		NewErrorMessage(ERR_NOT_ALLOWED, "The key of the node is not allowed", nil).Send(conn)
+		return false
+	}
+	if conn.tlsKey != "" && conn.tlsKey != data.PublicKey {
+		logger.Alert(fmt.Sprintf("The node %s:%s claimed a key other than the one of its certificate", data.Address, data.Port))
+		NewErrorMessage(ERR_UNAUTHENTICATED, "The key is not the key of the certificate", nil).Send(conn)
+		return false
+	}
+
+	transcript := handshakeTranscript{
+		DialerNonce:  data.Nonce,
+		DialerKey:    data.PublicKey,
+		ResponderKey: reply.PublicKey,
+	}
+
+	var err error
+	if transcript.ResponderNonce, err = newHandshakeNonce(); err == nil {
+		reply.Nonce = transcript.ResponderNonce
+		reply.Signature, err = transcript.sign(ctx, _HANDSHAKE_RESPONDER)
+	}
+	if err != nil {
+		errorMessageFrom(err, nil).Send(conn)
+		return false
+	}
+
+	// the reply still goes in the framing of the request, the rest of the
+	// handshake in the negotiated one
+	NewMessage(OK).AddContent(*reply).Send(conn)
+	conn.SetFraming(reply.Framing)
+
+	payload, _, err := ReadFromConnection(conn)
+	msg, ok := MessageFromPayload(payload)
+	if err != nil || !ok || msg.header != AUTH {
+		logger.Alert(fmt.Sprintf("The node %s:%s did not finish the handshake", data.Address, data.Port), err)
+		NewErrorMessage(ERR_UNAUTHENTICATED, "Expected the AUTH message of the handshake", nil).Send(conn)
+		return false
+	}
+
+	auth, err := unmarshallJson[authDTO](msg.content)
+	if err == nil {
+		err = transcript.verify(_HANDSHAKE_DIALER, data.PublicKey, auth.Signature)
+	}
+	if err != nil {
+		logger.Alert(fmt.Sprintf("The node %s:%s failed to prove its key", data.Address, data.Port))
+		NewErrorMessage(ERR_UNAUTHENTICATED, errUnauthenticated.Error(), nil).Send(conn)
+		return false
+	}
 
 	NewMessage(OK).Send(conn)
 	return true
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/iblt"
+	"bftkvstore/logger"
+	"bftkvstore/set"
+	"encoding/hex"
+)
+
+// Peers that negotiated sketches reconcile a key whose heads are missing as
+// a set instead of walking its history back one NEED round-trip per level:
+// the node sends an invertible Bloom lookup table of the hashes of the
+// operations of the key, and the peer subtracts its own table from it and
+// decodes the operations only one of them has. The peer sends the operations
+// the node lacks and asks for the ones it lacks itself. A table too small for
+// the difference does not decode, then the peer asks for one twice as large,
+// up to _SKETCH_MAX_CELLS, after which the key falls back to NEED.
+const (
+	_SKETCH_MIN_CELLS = 64
+	_SKETCH_MAX_CELLS = 4096
+)
+
+type sketchDTO struct {
+	Key    string `json:"key"`
+	Table  []byte `json:"table,omitempty"`  // hashes of the operations of the key
+	Cells  int    `json:"cells,omitempty"`  // asks for a table of that many cells
+	Failed bool   `json:"failed,omitempty"` // the difference is too large for any table
+}
+
+func sendSketch(ctx *context.AppContext, connData *connectionData, key string, cells int) {
+	connData.vars.sketched = set.Add(connData.vars.sketched, key)
+
+	table := operationsTable(keyOperations(ctx, key), cells)
+	encoded, err := table.MarshalBinary()
+	if err != nil {
+		logger.Error("Failed to encode the sketch of", key, err)
+		return
+	}
+
+	logger.Debug("Sending a sketch of", table.Cells(), "cells for", key, "to", connData.name)
+	NewMessage(SKETCH).AddContent(sketchDTO{Key: key, Table: encoded}).Send(connData.conn)
+}
+
+func onReceivingSketch(ctx *context.AppContext, connData *connectionData, body []byte) {
+	data, err := unmarshallJson[sketchDTO](body)
+	if err != nil {
+		logger.Error("Failed to parse sketch JSON", err)
+		return
+	}
+
+	switch {
+	case data.Failed:
+		// the key is already sketched, so this falls back to NEED
+		handleMissing(ctx, connData, data.Key, set.New[string]())
+		return
+	case data.Table == nil:
+		if data.Cells > 0 && data.Cells <= _SKETCH_MAX_CELLS {
+			sendSketch(ctx, connData, data.Key, data.Cells)
+		}
+		return
+	}
+
+	var theirs iblt.Table
+	if err := theirs.UnmarshalBinary(data.Table); err != nil || theirs.Cells() > _SKETCH_MAX_CELLS {
+		logger.Alert("Ignoring a malformed sketch from", connData.name)
+		return
+	}
+
+	ops := keyOperations(ctx, data.Key)
+	diff, err := operationsTable(ops, theirs.Cells()).Subtract(&theirs)
+	if err != nil {
+		logger.Error("Failed to compare the sketch of", data.Key, err)
+		return
+	}
+
+	onlyOurs, onlyTheirs, ok := diff.Decode()
+	if !ok {
+		reply := sketchDTO{Key: data.Key, Cells: theirs.Cells() * 2}
+		if reply.Cells > _SKETCH_MAX_CELLS {
+			reply = sketchDTO{Key: data.Key, Failed: true}
+		}
+		logger.Debug("Failed to decode the sketch of", data.Key, "from", connData.name)
+		NewMessage(SKETCH).AddContent(reply).Send(connData.conn)
+		return
+	}
+
+	absent := make(map[string]bool)
+	for _, hash := range onlyOurs {
+		absent[hex.EncodeToString(hash[:])] = true
+	}
+	push := set.New[string]()
+	for _, op := range ops {
+		if absent[hashOf(op)] && !set.Has(connData.vars.sent, op) {
+			push = set.Add(push, op)
+		}
+	}
+	if len(push) > 0 {
+		logger.Debug("Sending", len(push), "operations of", data.Key, "decoded from the sketch of", connData.name)
+		connData.vars.sent = set.Union(connData.vars.sent, push)
+		newMsgsMessage(msgsDTO{Key: data.Key, Messages: push}, connData.conn.RawOps()).Send(connData.conn)
+	}
+
+	// the key was just compared, so what is missing here is asked for
+	// directly instead of sketched back
+	if len(onlyTheirs) > 0 {
+		missing := set.New[string]()
+		for _, hash := range onlyTheirs {
+			missing = set.Add(missing, hex.EncodeToString(hash[:]))
+		}
+		connData.vars.sketched = set.Add(connData.vars.sketched, data.Key)
+		handleMissing(ctx, connData, data.Key, missing)
+	}
+}
+
+func operationsTable(ops []string, cells int) *iblt.Table {
+	table := iblt.New(cells)
+	for _, op := range ops {
+		var key iblt.Key
+		copy(key[:], hashBytes(hashOf(op)))
+		table.Insert(key)
+	}
+	return table
+}
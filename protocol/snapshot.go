@@ -0,0 +1,433 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/crdts"
+	"bftkvstore/logger"
+	"bftkvstore/set"
+	"bftkvstore/utils"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A node that starts without keys asks a peer for a snapshot instead of
+// pulling every operation through NEED. The peer puts the operations of the
+// keys of a range (as in digests), in the order they were stored, in a bundle
+// and signs its SHA-256 with its key. The node downloads the bundle in chunks
+// by offset, so a download cut by a lost connection resumes where it stopped
+// once the same peer is connected again. A complete bundle is checked against
+// its hash and signature, and every operation against its signature and
+// predecessors, before any of it is installed. Heads are not compared during
+// the download, the next round catches up with what changed meanwhile.
+// Nodes only ask for the whole range for now. Bundles are costly to create, so
+// one is reused for its range while no operation was added, or for a minute,
+// and each peer gets at most one new bundle a minute.
+const (
+	_SNAPSHOT_CHUNK_SIZE   = 1 << 20
+	_SNAPSHOT_MAX_SIZE     = 1 << 30
+	_SNAPSHOT_BUNDLES_KEPT = 4                // bundles kept to resume downloads
+	_SNAPSHOT_STALE        = 90 * time.Second // before another peer takes over a download, or a bundle is dropped
+	_SNAPSHOT_INTERVAL     = time.Minute
+
+	_SNAPSHOT_SIGNED_PREFIX = "bftkvstore snapshot\n"
+)
+
+var errInvalidSnapshot = errors.New("Invalid snapshot")
+var errSnapshotTooSoon = errors.New("A snapshot was already created for the peer within a minute")
+
+type snapshotRequestDTO struct {
+	Prefix string `json:"prefix"`
+	Bundle string `json:"bundle,omitempty"` // hash of the bundle being resumed
+	Offset int    `json:"offset"`
+}
+
+type snapshotChunkDTO struct {
+	Prefix    string `json:"prefix"`
+	Bundle    string `json:"bundle"` // hex encoded SHA-256 of the whole bundle
+	Size      int    `json:"size"`
+	Offset    int    `json:"offset"`
+	Data      []byte `json:"data"`
+	Signature string `json:"signature"` // of the prefix, bundle and size by the peer
+}
+
+type snapshotKeyDTO struct {
+	Key        string   `json:"key"`
+	Operations [][]byte `json:"operations"` // predecessors first
+}
+
+type snapshotBundle struct {
+	prefix     string
+	hash       string
+	data       []byte
+	signature  string
+	operations int // operations stored when it was created
+	created    time.Time
+	used       time.Time
+}
+
+type snapshotDownload struct {
+	peer      string // id of the peer serving the bundle
+	prefix    string
+	bundle    string
+	size      int
+	signature string
+	data      []byte
+	updated   time.Time
+}
+
+var lockSnapshots sync.Mutex
+var servedBundles []*snapshotBundle
+var bundlesCreated = make(map[string]time.Time) // peer id -> last bundle created for it
+var download *snapshotDownload                  // at most one at a time, kept across reconnections
+var snapshotPeers = make(map[string]bool)       // peers a snapshot was downloaded from
+
+// Starts or resumes the download of a snapshot from the peer, when the node
+// has no keys yet or was already downloading from it
+func requestSnapshot(ctx *context.AppContext, connData *connectionData) (requested bool) {
+	if !connData.conn.Snapshots() || connData.conn.PeerKey() == "" {
+		return false
+	}
+
+	lockSnapshots.Lock()
+	defer lockSnapshots.Unlock()
+
+	if download != nil && download.peer != connData.id && time.Since(download.updated) > _SNAPSHOT_STALE {
+		logger.Alert("Giving up on the snapshot from", download.peer)
+		download = nil
+	}
+	if download == nil {
+		if snapshotPeers[connData.id] || !hasNoOperations(ctx) {
+			return false
+		}
+		download = &snapshotDownload{peer: connData.id, updated: time.Now()}
+	}
+	if download.peer != connData.id {
+		return false
+	}
+
+	logger.Info("Downloading a snapshot from", connData.name, "at offset", len(download.data))
+	NewMessage(Q_SNAPSHOT).AddContent(snapshotRequestDTO{
+		Prefix: download.prefix,
+		Bundle: download.bundle,
+		Offset: len(download.data),
+	}).Send(connData.conn)
+	return true
+}
+
+func downloadingSnapshot() bool {
+	lockSnapshots.Lock()
+	defer lockSnapshots.Unlock()
+	return download != nil
+}
+
+func hasNoOperations(ctx *context.AppContext) bool {
+	for _, key := range ctx.Storage.List() {
+		if key.Operations > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func snapshotSignedBytes(prefix string, bundle string, size int) []byte {
+	return []byte(fmt.Sprintf("%s%s\n%s\n%d", _SNAPSHOT_SIGNED_PREFIX, prefix, bundle, size))
+}
+
+func onReceivingSnapshotRequest(ctx *context.AppContext, connData *connectionData, body []byte) {
+	data, err := unmarshallJson[snapshotRequestDTO](body)
+	if err != nil || !isValidPrefix(data.Prefix) {
+		logger.Error("Failed to parse snapshot request JSON", err)
+		return
+	}
+
+	bundle, found := servedBundle(data.Prefix, data.Bundle)
+	if !found {
+		if bundle, err = snapshotFor(ctx, connData, data.Prefix); err != nil {
+			logger.Alert("Refused a snapshot to", connData.name, err)
+			return
+		}
+	}
+
+	// a bundle that is gone is sent again from the start
+	offset := data.Offset
+	if !found || offset < 0 || offset > len(bundle.data) {
+		offset = 0
+	}
+	end := min(offset+_SNAPSHOT_CHUNK_SIZE, len(bundle.data))
+
+	NewMessage(SNAPSHOT).AddContent(snapshotChunkDTO{
+		Prefix:    bundle.prefix,
+		Bundle:    bundle.hash,
+		Size:      len(bundle.data),
+		Offset:    offset,
+		Data:      bundle.data[offset:end],
+		Signature: bundle.signature,
+	}).Send(connData.conn)
+}
+
+func servedBundle(prefix string, hash string) (bundle *snapshotBundle, found bool) {
+	lockSnapshots.Lock()
+	defer lockSnapshots.Unlock()
+
+	for _, bundle := range servedBundles {
+		if bundle.prefix == prefix && bundle.hash == hash {
+			bundle.used = time.Now()
+			return bundle, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the newest bundle of the range when it can be reused, or creates
+// one unless the peer got one too recently
+func snapshotFor(ctx *context.AppContext, connData *connectionData, prefix string) (*snapshotBundle, error) {
+	lockM.Lock()
+	operations := len(M)
+	lockM.Unlock()
+
+	lockSnapshots.Lock()
+	servedBundles = slices.DeleteFunc(servedBundles, func(bundle *snapshotBundle) bool {
+		return time.Since(bundle.used) > _SNAPSHOT_STALE
+	})
+	for peer, created := range bundlesCreated {
+		if time.Since(created) > _SNAPSHOT_INTERVAL {
+			delete(bundlesCreated, peer)
+		}
+	}
+
+	for _, bundle := range slices.Backward(servedBundles) {
+		if bundle.prefix == prefix && (bundle.operations == operations || time.Since(bundle.created) < _SNAPSHOT_INTERVAL) {
+			bundle.used = time.Now()
+			lockSnapshots.Unlock()
+			return bundle, nil
+		}
+	}
+	if _, exists := bundlesCreated[connData.id]; exists {
+		lockSnapshots.Unlock()
+		return nil, errSnapshotTooSoon
+	}
+	bundlesCreated[connData.id] = time.Now()
+	lockSnapshots.Unlock()
+
+	bundle, err := newSnapshotBundle(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	bundle.operations = operations
+
+	lockSnapshots.Lock()
+	servedBundles = append(servedBundles, bundle)
+	servedBundles = servedBundles[max(len(servedBundles)-_SNAPSHOT_BUNDLES_KEPT, 0):]
+	lockSnapshots.Unlock()
+
+	return bundle, nil
+}
+
+func newSnapshotBundle(ctx *context.AppContext, prefix string) (*snapshotBundle, error) {
+	keys := make([]snapshotKeyDTO, 0)
+	for _, key := range keysInRange(ctx, prefix) {
+		ops, err := ctx.Storage.GetOperations(key.key)
+		if err != nil || len(ops) == 0 {
+			continue
+		}
+
+		// the storage keeps operations after their predecessors
+		encoded := make([][]byte, len(ops))
+		for idx, op := range ops {
+			encoded[idx] = op
+		}
+		keys = append(keys, snapshotKeyDTO{Key: key.key, Operations: encoded})
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > _SNAPSHOT_MAX_SIZE {
+		return nil, errors.New("The snapshot is too large")
+	}
+
+	hash := sha256.Sum256(data)
+	bundle := &snapshotBundle{prefix: prefix, hash: hex.EncodeToString(hash[:]), data: data, created: time.Now(), used: time.Now()}
+	bundle.signature = hex.EncodeToString(ed25519.Sign(ctx.Secretkey, snapshotSignedBytes(prefix, bundle.hash, len(data))))
+
+	logger.Info("Created a snapshot of", len(keys), "keys,", len(data), "bytes")
+	return bundle, nil
+}
+
+func onReceivingSnapshot(ctx *context.AppContext, connData *connectionData, body []byte) {
+	data, err := unmarshallJson[snapshotChunkDTO](body)
+	if err != nil {
+		logger.Error("Failed to parse snapshot JSON", err)
+		return
+	}
+
+	lockSnapshots.Lock()
+	if download == nil || download.peer != connData.id {
+		lockSnapshots.Unlock()
+		return
+	}
+
+	if data.Bundle != download.bundle || data.Prefix != download.prefix {
+		if err := verifySnapshotSignature(connData.conn.PeerKey(), data); err != nil {
+			lockSnapshots.Unlock()
+			logger.Alert("Ignoring a snapshot from", connData.name, err)
+			return
+		}
+		*download = snapshotDownload{
+			peer:      download.peer,
+			prefix:    data.Prefix,
+			bundle:    data.Bundle,
+			size:      data.Size,
+			signature: data.Signature,
+			data:      make([]byte, 0),
+		}
+	}
+
+	if data.Offset != len(download.data) || len(download.data)+len(data.Data) > download.size {
+		lockSnapshots.Unlock()
+		logger.Alert("Ignoring a snapshot chunk out of place from", connData.name)
+		return
+	}
+	download.data = append(download.data, data.Data...)
+	download.updated = time.Now()
+
+	if len(download.data) < download.size {
+		lockSnapshots.Unlock()
+		requestSnapshot(ctx, connData)
+		return
+	}
+
+	completed := download
+	download = nil
+	snapshotPeers[connData.id] = true
+	lockSnapshots.Unlock()
+
+	keys, err := readSnapshot(ctx, completed)
+	if err == nil {
+		err = installSnapshot(ctx, connData, keys)
+	}
+	if err != nil {
+		logger.Alert("Failed to install the snapshot from", connData.name, err)
+	} else {
+		logger.Info("Installed a snapshot of", len(keys), "keys from", connData.name)
+	}
+
+	// catches up with what changed since, or reconciles as usual
+	onConnectionToAnotherReplica(ctx, connData)
+}
+
+func verifySnapshotSignature(peerKey string, data snapshotChunkDTO) error {
+	key, err := hex.DecodeString(peerKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errInvalidSnapshot
+	}
+	signature, err := hex.DecodeString(data.Signature)
+	if err != nil || data.Size < 0 || data.Size > _SNAPSHOT_MAX_SIZE || !isValidPrefix(data.Prefix) ||
+		!ed25519.Verify(key, snapshotSignedBytes(data.Prefix, data.Bundle, data.Size), signature) {
+		return errInvalidSnapshot
+	}
+	return nil
+}
+
+// Checks the bundle matches its hash and every operation is valid, follows its
+// predecessors, in the bundle or already stored, and belongs to its key
+func readSnapshot(ctx *context.AppContext, completed *snapshotDownload) ([]snapshotKeyDTO, error) {
+	hash := sha256.Sum256(completed.data)
+	if hex.EncodeToString(hash[:]) != completed.bundle {
+		return nil, fmt.Errorf("%w: the bundle does not match its hash", errInvalidSnapshot)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(completed.data))
+	decoder.DisallowUnknownFields()
+	var keys []snapshotKeyDTO
+	if err := decoder.Decode(&keys); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidSnapshot, err)
+	}
+
+	for _, key := range keys {
+		position := sha256.Sum256([]byte(key.Key))
+		if !strings.HasPrefix(hex.EncodeToString(position[:]), completed.prefix) {
+			return nil, fmt.Errorf("%w: the key %s is not in the range", errInvalidSnapshot, key.Key)
+		}
+
+		// the type of the key is known once its "new" operation is, operations
+		// must have it so none fails to install. Only claims of the alias
+		// registry, which has no "new" operation, may have no preds.
+		known := set.FromSlice(utils.Map(keyOperations(ctx, key.Key), hashOf))
+		var keyType crdts.CRDT_TYPE
+		if stored, err := ctx.Storage.Get(key.Key); err == nil {
+			keyType = stored.Type
+		}
+		for _, signedOp := range key.Operations {
+			op, err := crdts.ReadOperation(signedOp)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", errInvalidSnapshot, err)
+			}
+			hash := crdts.HashOperation(crdts.SignedOperation(signedOp))
+
+			switch {
+			case op.Op == "new" && hash != key.Key,
+				op.Op != "new" && op.Type != keyType,
+				op.Type == crdts.CRDT_ALIAS && key.Key != crdts.ALIAS_REGISTRY_KEY,
+				op.Op != "new" && op.Type != crdts.CRDT_ALIAS && len(op.Preds) == 0:
+				return nil, fmt.Errorf("%w: the operation %s does not belong to %s", errInvalidSnapshot, hash, key.Key)
+			}
+			if op.Op == "new" {
+				keyType = op.Type
+			}
+			for _, pred := range op.Preds {
+				if !set.Has(known, pred) {
+					return nil, fmt.Errorf("%w: the operation %s comes before its predecessor %s", errInvalidSnapshot, hash, pred)
+				}
+			}
+			known = set.Add(known, hash)
+		}
+	}
+
+	return keys, nil
+}
+
+// The operations were validated by readSnapshot, so installing them only fails
+// when the keys changed in between. The storage keeps what was installed
+// until then, so it is added to both M and the operations of the connection.
+func installSnapshot(ctx *context.AppContext, connData *connectionData, keys []snapshotKeyDTO) error {
+	lockM.Lock()
+	defer lockM.Unlock()
+
+	installed := set.New[string]()
+	defer func() {
+		M = set.Union(M, installed)
+		connData.vars.mconn = set.Union(connData.vars.mconn, installed)
+	}()
+
+	for _, key := range keys {
+		for _, op := range key.Operations {
+			signedOp := crdts.SignedOperation(op)
+			if set.Has(M, string(signedOp)) {
+				continue
+			}
+
+			var err error
+			if crdts.HashOperation(signedOp) == key.Key {
+				err = ctx.Storage.Assign(key.Key, signedOp)
+			} else {
+				err = ctx.Storage.Append(key.Key, signedOp)
+			}
+			if err != nil {
+				return fmt.Errorf("Could not install an operation of %s: %w", key.Key, err)
+			}
+			installed = set.Add(installed, string(signedOp))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/crdts"
+	"bftkvstore/set"
+	"bftkvstore/utils"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newSnapshotTestOperations(t *testing.T) (key string, ops [][]byte) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+
+	op0, _, err := crdts.NewCounterOp(secretkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op1, err := crdts.IncCounterOp(secretkey, 1, []crdts.SignedOperation{op0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op2, err := crdts.IncCounterOp(secretkey, 2, []crdts.SignedOperation{op1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return crdts.HashOperation(op0), [][]byte{op0, op1, op2}
+}
+
+func snapshotDownloadOf(t *testing.T, prefix string, keys []snapshotKeyDTO) *snapshotDownload {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	return &snapshotDownload{prefix: prefix, bundle: hex.EncodeToString(hash[:]), size: len(data), data: data}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	ctx := context.New(secretkey, "127.0.0.1", "8089")
+
+	key, ops := newSnapshotTestOperations(t)
+	position := sha256.Sum256([]byte(key))
+	otherPrefix := "0"
+	if strings.HasPrefix(hex.EncodeToString(position[:]), otherPrefix) {
+		otherPrefix = "1"
+	}
+	otherKey, otherOps := newSnapshotTestOperations(t)
+	withoutPreds, _ := crdts.IncCounterOp(secretkey, 1, nil)
+	otherType, _ := crdts.AddGSetOp(secretkey, "a", []crdts.SignedOperation{ops[0]})
+	claim, _ := crdts.ClaimAliasOp(secretkey, "name", key, nil)
+
+	tests := []struct {
+		name     string
+		download *snapshotDownload
+		valid    bool
+	}{
+		{"valid", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: key, Operations: ops}}), true},
+		{"empty", snapshotDownloadOf(t, "", []snapshotKeyDTO{}), true},
+		{"tampered hash", func() *snapshotDownload {
+			download := snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: key, Operations: ops}})
+			download.data = append(download.data[:len(download.data)-1], ' ', ']')
+			return download
+		}(), false},
+		{"key outside the prefix", snapshotDownloadOf(t, otherPrefix, []snapshotKeyDTO{{Key: key, Operations: ops}}), false},
+		{"operation before its predecessor", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: key, Operations: [][]byte{ops[0], ops[2], ops[1]}}}), false},
+		{"operation of another key", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: key, Operations: append([][]byte{ops[0]}, otherOps[1:]...)}}), false},
+		{"new operation under the wrong key", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: otherKey, Operations: ops}}), false},
+		{"operation without preds", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: key, Operations: [][]byte{ops[0], withoutPreds}}}), false},
+		{"operation of another type", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: key, Operations: [][]byte{ops[0], otherType}}}), false},
+		{"claim of the alias registry", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: crdts.ALIAS_REGISTRY_KEY, Operations: [][]byte{claim}}}), true},
+		{"invalid operation", snapshotDownloadOf(t, "", []snapshotKeyDTO{{Key: key, Operations: [][]byte{ops[0][:len(ops[0])-1]}}}), false},
+	}
+
+	for _, test := range tests {
+		keys, err := readSnapshot(&ctx, test.download)
+		if test.valid && err != nil {
+			t.Error(test.name, "should be accepted but got", err)
+		}
+		if !test.valid && !errors.Is(err, errInvalidSnapshot) {
+			t.Error(test.name, "should be rejected but got", len(keys), "keys and", err)
+		}
+	}
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	ctx := context.New(secretkey, "127.0.0.1", "8089")
+	connData := &connectionData{vars: &connectionVariables{mconn: set.New[string]()}}
+	defer func() { M = set.New[string]() }()
+
+	key, ops := newSnapshotTestOperations(t)
+	otherKey, otherOps := newSnapshotTestOperations(t)
+
+	// the other key was not created, so its operations fail to install
+	err := installSnapshot(&ctx, connData, []snapshotKeyDTO{{Key: key, Operations: ops}, {Key: otherKey, Operations: otherOps[1:]}})
+	if err == nil {
+		t.Fatal("Expected the operations of the missing key to fail")
+	}
+
+	installed := set.FromSlice(utils.Map(ops, func(op []byte) string { return string(op) }))
+	if fmt.Sprint(M) != fmt.Sprint(installed) || fmt.Sprint(connData.vars.mconn) != fmt.Sprint(installed) {
+		t.Error("Expected the installed operations in both M and the connection but got", len(M), len(connData.vars.mconn))
+	}
+	if stored, _ := ctx.Storage.GetOperations(key); len(stored) != len(ops) {
+		t.Error("Expected the operations of the key to be stored but got", len(stored))
+	}
+}
+
+func TestVerifySnapshotSignature(t *testing.T) {
+	publicKey, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherSecretkey, _ := ed25519.GenerateKey(rand.Reader)
+	bundle := hex.EncodeToString(make([]byte, sha256.Size))
+
+	signed := func(secretkey ed25519.PrivateKey, prefix string, size int) snapshotChunkDTO {
+		signature := ed25519.Sign(secretkey, snapshotSignedBytes(prefix, bundle, size))
+		return snapshotChunkDTO{Prefix: prefix, Bundle: bundle, Size: size, Signature: hex.EncodeToString(signature)}
+	}
+
+	tests := []struct {
+		name  string
+		chunk snapshotChunkDTO
+		valid bool
+	}{
+		{"valid", signed(secretkey, "a1", 1024), true},
+		{"signed by another key", signed(otherSecretkey, "a1", 1024), false},
+		{"other size than signed", func() snapshotChunkDTO {
+			chunk := signed(secretkey, "a1", 1024)
+			chunk.Size = 2048
+			return chunk
+		}(), false},
+		{"oversized", signed(secretkey, "a1", _SNAPSHOT_MAX_SIZE+1), false},
+		{"negative size", signed(secretkey, "a1", -1), false},
+		{"invalid prefix", signed(secretkey, "xyz", 1024), false},
+	}
+
+	for _, test := range tests {
+		err := verifySnapshotSignature(hex.EncodeToString(publicKey), test.chunk)
+		if test.valid && err != nil {
+			t.Error(test.name, "should be accepted but got", err)
+		}
+		if !test.valid && err == nil {
+			t.Error(test.name, "should be rejected")
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bufio"
+	stdcontext "context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Listeners can take plaintext connections only, both kinds or TLS only. The
+// first byte of a TLS connection is a handshake record, which never starts a
+// message of the protocol. Nodes dial their peers with TLS unless it is off,
+// falling back to plaintext when it is optional and the listener answered
+// that it does not take TLS. Nodes whose key is known are never downgraded.
+type TLSMode string
+
+const (
+	TLS_OFF      TLSMode = "off"
+	TLS_OPTIONAL TLSMode = "optional"
+	TLS_REQUIRED TLSMode = "required"
+
+	_TLS_HANDSHAKE_RECORD byte = 0x16
+
+	_TLS_ALERT_PROTOCOL_VERSION tls.AlertError = 70
+)
+
+// A fatal protocol_version alert record
+var tlsRejection = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, byte(_TLS_ALERT_PROTOCOL_VERSION)}
+
+var dialTLS TLSMode = TLS_OFF
+var tlsConfig *tls.Config
+
+func ParseTLSMode(mode string) (TLSMode, error) {
+	switch TLSMode(mode) {
+	case TLS_OFF, TLS_OPTIONAL, TLS_REQUIRED:
+		return TLSMode(mode), nil
+	default:
+		return TLS_OFF, errors.New(fmt.Sprintf("Unknown TLS mode %s, expected off, optional or required", mode))
+	}
+}
+
+// Creates the certificate of the node, self-signed with its key, and sets how
+// peers are dialed. There is no CA: certificates are accepted when they are
+// signed by the key they hold, and the peer must then prove that same key in
+// the handshake.
+func ConfigureTLS(ctx *context.AppContext, dialMode TLSMode) error {
+	publicKey := ctx.Secretkey.Public().(ed25519.PublicKey)
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hex.EncodeToString(publicKey)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, ctx.Secretkey)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: ctx.Secretkey}},
+		MinVersion:   tls.VersionTLS13,
+		// peers present their certificate too, clients usually do not
+		ClientAuth:         tls.RequestClientCert,
+		InsecureSkipVerify: true, // replaced by VerifyConnection
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, err := tlsPeerKey(state)
+			return err
+		},
+	}
+	dialTLS = dialMode
+
+	return nil
+}
+
+// Returns the key of the self-signed certificate of the other side, empty if
+// it sent none
+func tlsPeerKey(state tls.ConnectionState) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+
+	certificate := state.PeerCertificates[0]
+	publicKey, isEd25519 := certificate.PublicKey.(ed25519.PublicKey)
+	if !isEd25519 {
+		return "", errors.New("The certificate does not hold an ed25519 key")
+	}
+	err := certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature)
+	if err != nil {
+		return "", errors.New("The certificate is not signed by its key")
+	}
+
+	return hex.EncodeToString(publicKey), nil
+}
+
+// Starts TLS on an accepted connection when the listener requires it, or when
+// it allows it and the client began a TLS handshake. Listeners without TLS
+// refuse handshakes right away with an alert, so nodes that dial with optional
+// TLS fall back to plaintext without waiting for a timeout.
+func acceptTLS(runCtx stdcontext.Context, conn net.Conn, mode TLSMode) (*Conn, error) {
+	// the client may never send anything, so do not hold up the shutdown
+	stopClosing := stdcontext.AfterFunc(runCtx, func() { conn.Close() })
+	defer stopClosing()
+
+	conn.SetReadDeadline(time.Now().Add(_CLIENT_READ_TIMEOUT))
+	reader := bufio.NewReaderSize(conn, READER_SIZE)
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	// the peeked bytes stay in the reader, which the connection reads from
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	if first[0] == _TLS_HANDSHAKE_RECORD && (mode == TLS_OFF || tlsConfig == nil) {
+		rejectTLS(conn, reader)
+		return nil, errors.New("The listener does not accept TLS connections")
+	}
+	if first[0] != _TLS_HANDSHAKE_RECORD {
+		if mode == TLS_REQUIRED {
+			return nil, errors.New("The listener only accepts TLS connections")
+		}
+		return NewConn(peeked), nil
+	}
+
+	return startTLS(runCtx, tls.Server(peeked, tlsConfig))
+}
+
+// Answers the hello of the client with the alert. The hello is read first as
+// closing with unread data resets the connection, which may drop the alert.
+func rejectTLS(conn net.Conn, reader *bufio.Reader) {
+	conn.SetDeadline(time.Now().Add(_CLIENT_READ_TIMEOUT))
+	if header, err := reader.Peek(5); err == nil {
+		reader.Discard(5 + int(binary.BigEndian.Uint16(header[3:])))
+	}
+	conn.Write(tlsRejection)
+}
+
+// Whether the listener answered the handshake with the alert of listeners
+// that do not take TLS
+func rejectedTLS(err error) bool {
+	var remote *net.OpError
+	return errors.As(err, &remote) && remote.Op == "remote error" && remote.Err.Error() == _TLS_ALERT_PROTOCOL_VERSION.Error()
+}
+
+// Dials the address with TLS unless it is off. With optional TLS, listeners
+// that reject TLS are dialed again in plaintext, unless the key of the node is
+// known, as anyone on the path could send that rejection.
+func dialWithTLS(runCtx stdcontext.Context, address string, knownKey bool) (*Conn, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(runCtx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if dialTLS == TLS_OFF || tlsConfig == nil {
+		return NewConn(netConn), nil
+	}
+
+	conn, err := startTLS(runCtx, tls.Client(netConn, tlsConfig))
+	if err != nil && dialTLS == TLS_OPTIONAL && rejectedTLS(err) {
+		if knownKey {
+			return nil, errors.New("The node does not accept TLS, and its key is known so it is not dialed in plaintext")
+		}
+		if netConn, err = dialer.DialContext(runCtx, "tcp", address); err != nil {
+			return nil, err
+		}
+		return NewConn(netConn), nil
+	}
+	return conn, err
+}
+
+func startTLS(runCtx stdcontext.Context, tlsConn *tls.Conn) (*Conn, error) {
+	handshakeCtx, cancel := stdcontext.WithTimeout(runCtx, _CLIENT_READ_TIMEOUT)
+	defer cancel()
+
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	conn := NewConn(tlsConn)
+	conn.tlsKey, _ = tlsPeerKey(tlsConn.ConnectionState())
+	return conn, nil
+}
+
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *peekedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// Listens on a local port and hands each connection to accept, returning the
+// address and the count of accepted connections
+func listenForTest(t *testing.T, accept func(conn net.Conn)) (string, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go accept(conn)
+		}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+func TestDialWithTLS(t *testing.T) {
+	ctx := newHandshakeTestContext()
+	if err := ConfigureTLS(&ctx, TLS_OPTIONAL); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { dialTLS, tlsConfig = TLS_OFF, nil }()
+
+	acceptWith := func(mode TLSMode) func(conn net.Conn) {
+		return func(conn net.Conn) {
+			accepted, err := acceptTLS(stdcontext.Background(), conn, mode)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			defer accepted.Close()
+			if _, _, err := ReadFromConnection(accepted); err == nil {
+				NewMessage(PONG).Send(accepted)
+			}
+		}
+	}
+	closeRightAway := func(conn net.Conn) { conn.Close() }
+
+	tests := []struct {
+		name     string
+		accept   func(conn net.Conn)
+		knownKey bool
+		tls      bool // the connection is expected to use TLS
+		dials    int32
+		valid    bool
+	}{
+		{"listener with TLS", acceptWith(TLS_OPTIONAL), true, true, 1, true},
+		{"listener rejecting TLS", acceptWith(TLS_OFF), false, false, 2, true},
+		{"listener rejecting TLS to a known key", acceptWith(TLS_OFF), true, false, 1, false},
+		{"failed handshake", closeRightAway, false, false, 1, false},
+	}
+
+	for _, test := range tests {
+		address, dials := listenForTest(t, test.accept)
+
+		conn, err := dialWithTLS(stdcontext.Background(), address, test.knownKey)
+		if test.valid {
+			if err != nil {
+				t.Error(test.name, "should connect but got", err)
+				continue
+			}
+			if _, isTLS := conn.Conn.(*tls.Conn); isTLS != test.tls {
+				t.Error(test.name, "should use TLS:", test.tls)
+			}
+			// once answered every dial was accepted
+			if _, err := NewMessage(PING).SendAwaitRead(conn); err != nil {
+				t.Error(test.name, "should be answered but got", err)
+			}
+			conn.Close()
+		} else if err == nil {
+			t.Error(test.name, "should fail without falling back to plaintext")
+			conn.Close()
+		}
+
+		if dials.Load() != test.dials {
+			t.Error(test.name, "should dial", test.dials, "times but dialed", dials.Load())
+		}
+	}
+}
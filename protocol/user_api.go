@@ -4,23 +4,27 @@ import (
 	"bftkvstore/context"
 	"bftkvstore/crdts"
 	"bftkvstore/logger"
+	"bftkvstore/set"
+	"bftkvstore/storage"
+	"bftkvstore/utils"
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
-	"net"
+	"slices"
+	"strings"
 )
 
-func newMsg(ctx *context.AppContext, conn net.Conn, body []byte) {
+func newMsg(ctx *context.AppContext, conn *Conn, body []byte) {
 	type newMsgBody struct {
 		Type crdts.CRDT_TYPE `json:"type"`
 	}
 
 	data, err := unmarshallJson[newMsgBody](body)
 	if err != nil {
-		NewMessage(NO).Send(conn)
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with the type of the CRDT", nil).Send(conn)
 		return
 	}
 
@@ -29,14 +33,14 @@ func newMsg(ctx *context.AppContext, conn net.Conn, body []byte) {
 	op, opId, err := crdts.NewCRDT(crdtType, ctx.Secretkey)
 	if err != nil {
 		logger.Error("Failed to create new", crdtType, "operation", err)
-		NewMessage(NO).Send(conn)
+		errorMessageFrom(err, nil).Send(conn)
 		return
 	}
 
 	assignErr := ctx.Storage.Assign(hex.EncodeToString(opId), op)
 	if assignErr != nil {
-		logger.Error("Failed to store new", crdtType, "operation", err)
-		NewMessage(NO).Send(conn)
+		logger.Error("Failed to store new", crdtType, "operation", assignErr)
+		errorMessageFrom(assignErr, nil).Send(conn)
 		return
 	}
 
@@ -52,20 +56,28 @@ func newMsg(ctx *context.AppContext, conn net.Conn, body []byte) {
 	}
 }
 
-func readMsg(ctx *context.AppContext, conn net.Conn, body []byte) {
+func readMsg(ctx *context.AppContext, conn *Conn, body []byte) {
 	type readMsgBody struct {
-		Key string `json:"key"`
+		Key string   `json:"key"`
+		At  []string `json:"at"` // optional causal frontier, as operation hashes
 	}
 	data, err := unmarshallJson[readMsgBody](body)
 	if err != nil {
-		NewMessage(NO).Send(conn)
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with a key", nil).Send(conn)
 		return
 	}
 
-	resultObject, err := ctx.Storage.Get(data.Key)
+	data.Key = resolveKey(ctx, data.Key)
+
+	var resultObject storage.GetResultDTO
+	if len(data.At) > 0 {
+		resultObject, err = ctx.Storage.GetAt(data.Key, data.At)
+	} else {
+		resultObject, err = ctx.Storage.Get(data.Key)
+	}
 	if err != nil {
 		logger.Alert("Error getting item from key: ", err)
-		NewMessage(NO).Send(conn)
+		errorMessageFrom(err, nil).Send(conn)
 		return
 	}
 
@@ -73,43 +85,361 @@ func readMsg(ctx *context.AppContext, conn net.Conn, body []byte) {
 		Key   string          `json:"key"`
 		Value interface{}     `json:"value"`
 		Type  crdts.CRDT_TYPE `json:"type"`
+		Heads set.Set[string] `json:"heads"`
 	}{
 		Key:   data.Key,
 		Value: resultObject.Value,
 		Type:  resultObject.Type,
+		Heads: headHashes(resultObject.Heads),
 	}).Send(conn)
 	if err != nil {
 		logger.Error(err)
 	}
 }
 
-func opMsg(opType MessageHeader, ctx *context.AppContext, conn net.Conn, body []byte) {
+const _HIST_DEFAULT_LIMIT = 100
+
+type histOperationDTO struct {
+	Hash    string      `json:"hash"`
+	Author  string      `json:"author"`
+	Op      string      `json:"op"`
+	Payload interface{} `json:"payload"`
+	Preds   []string    `json:"preds"`
+}
+
+func histMsg(ctx *context.AppContext, conn *Conn, body []byte) {
+	type histMsgBody struct {
+		Key    string `json:"key"`
+		Author string `json:"author"`
+		Offset int    `json:"offset"`
+		Limit  int    `json:"limit"`
+	}
+
+	data, err := unmarshallJson[histMsgBody](body)
+	if err != nil || data.Offset < 0 || data.Limit < 0 {
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with a key and a non-negative offset and limit", nil).Send(conn)
+		return
+	}
+
+	data.Key = resolveKey(ctx, data.Key)
+
+	if data.Limit == 0 {
+		data.Limit = _HIST_DEFAULT_LIMIT
+	}
+
+	signedOps, err := ctx.Storage.GetOperations(data.Key)
+	if err != nil {
+		logger.Alert("Error getting operations from key: ", err)
+		errorMessageFrom(err, nil).Send(conn)
+		return
+	}
+
+	ordered := crdts.CalculateOperationsTopologicalOrder(signedOps)
+
+	history := make([]histOperationDTO, 0)
+	for _, signedOp := range ordered {
+		author := crdts.OperationAuthor(signedOp)
+		if data.Author != "" && data.Author != author {
+			continue
+		}
+
+		op, err := crdts.ReadOperation(signedOp)
+		if err != nil {
+			continue
+		}
+
+		history = append(history, histOperationDTO{
+			Hash:    crdts.HashOperation(signedOp),
+			Author:  author,
+			Op:      op.Op,
+			Payload: op.Crdt,
+			Preds:   op.Preds,
+		})
+	}
+
+	total := len(history)
+	start := min(data.Offset, total)
+	end := min(start+data.Limit, total)
+
+	err = NewMessage(OK).AddContent(struct {
+		Key        string             `json:"key"`
+		Total      int                `json:"total"`
+		Offset     int                `json:"offset"`
+		Operations []histOperationDTO `json:"operations"`
+	}{
+		Key:        data.Key,
+		Total:      total,
+		Offset:     start,
+		Operations: history[start:end],
+	}).Send(conn)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+const _LIST_DEFAULT_LIMIT = 100
+
+type listKeyDTO struct {
+	Key        string          `json:"key"`
+	Type       crdts.CRDT_TYPE `json:"type"`
+	Operations int             `json:"operations"`
+	Creator    string          `json:"creator"`
+}
+
+func listMsg(ctx *context.AppContext, conn *Conn, body []byte) {
+	type listMsgBody struct {
+		Prefix  string          `json:"prefix"`
+		Cursor  string          `json:"cursor"` // last key of the previous page
+		Type    crdts.CRDT_TYPE `json:"type"`
+		Creator string          `json:"creator"`
+		Limit   int             `json:"limit"`
+	}
+
+	data, err := unmarshallJson[listMsgBody](body)
+	if err != nil || data.Limit < 0 {
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with a non-negative limit", nil).Send(conn)
+		return
+	}
+
+	if data.Limit == 0 {
+		data.Limit = _LIST_DEFAULT_LIMIT
+	}
+
+	keys := make([]listKeyDTO, 0)
+	next := ""
+	for _, info := range ctx.Storage.List() {
+		if info.Key <= data.Cursor ||
+			!strings.HasPrefix(info.Key, data.Prefix) ||
+			(data.Type != "" && data.Type != info.Type) ||
+			(data.Creator != "" && data.Creator != info.Creator) {
+			continue
+		}
+
+		if len(keys) == data.Limit {
+			next = keys[len(keys)-1].Key
+			break
+		}
+
+		keys = append(keys, listKeyDTO{
+			Key:        info.Key,
+			Type:       info.Type,
+			Operations: info.Operations,
+			Creator:    info.Creator,
+		})
+	}
+
+	err = NewMessage(OK).AddContent(struct {
+		Keys []listKeyDTO `json:"keys"`
+		Next string       `json:"next"` // empty when there are no more keys
+	}{
+		Keys: keys,
+		Next: next,
+	}).Send(conn)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func opMsg(opType MessageHeader, ctx *context.AppContext, conn *Conn, body []byte) {
 	type readMsgBody struct {
-		Key   string `json:"key"`
-		Value any    `json:"value"`
+		Key         string   `json:"key"`
+		Value       any      `json:"value"`
+		ExpectHeads []string `json:"expectHeads"` // optional, applies the op only on these heads
 	}
 
 	data, err := unmarshallJson[readMsgBody](body)
 	if err != nil {
-		NewMessage(NO).Send(conn)
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with a key and a value", nil).Send(conn)
 		return
 	}
 
+	data.Key = resolveKey(ctx, data.Key)
+
 	resultObject, err := ctx.Storage.Get(data.Key)
 	if err != nil {
 		logger.Alert("Error getting item from key: ", err)
-		NewMessage(NO).Send(conn)
+		errorMessageFrom(err, nil).Send(conn)
+		return
+	}
+
+	expectHeads := data.ExpectHeads != nil
+	if expectHeads && !slices.Equal(set.FromSlice(data.ExpectHeads), headHashes(resultObject.Heads)) {
+		sendHeadsConflict(conn, resultObject.Heads)
 		return
 	}
 
 	op, err := getOperation(opType, resultObject.Type, ctx.Secretkey, data.Value, resultObject.Heads)
-	if err == nil && storeOperation(ctx, conn, data.Key, op) {
+	if err != nil {
+		logger.Alert(err, data.Value)
+		errorMessageFrom(err, nil).Send(conn)
+		return
+	}
+
+	if expectHeads {
+		err = ctx.Storage.AppendOnHeads(data.Key, op)
+	} else {
+		err = ctx.Storage.Append(data.Key, op)
+	}
+
+	if errors.Is(err, storage.ErrHeadsChanged) {
+		current, _ := ctx.Storage.Get(data.Key)
+		sendHeadsConflict(conn, current.Heads)
+	} else if err != nil {
+		logger.Error("Failed to create operation on key", data.Key, "due to:", err)
+		errorMessageFrom(err, nil).Send(conn)
+	} else {
 		NewMessage(OK).Send(conn)
 		broadcast(ctx, data.Key, op)
+	}
+}
+
+func headHashes(heads []crdts.SignedOperation) set.Set[string] {
+	return set.FromSlice(utils.Map(heads, crdts.HashOperation))
+}
+
+// Tells the client that the key was concurrently modified, along with the
+// heads it has now
+func sendHeadsConflict(conn *Conn, heads []crdts.SignedOperation) {
+	errorMessageFrom(storage.ErrHeadsChanged, struct {
+		Heads set.Set[string] `json:"heads"`
+	}{
+		Heads: headHashes(heads),
+	}).Send(conn)
+}
+
+func batchMsg(ctx *context.AppContext, conn *Conn, body []byte) {
+	type batchOpBody struct {
+		Op    MessageHeader `json:"op"`
+		Key   string        `json:"key"`
+		Value any           `json:"value"`
+	}
+	type batchMsgBody struct {
+		Operations []batchOpBody `json:"operations"`
+	}
+
+	data, err := unmarshallJson[batchMsgBody](body)
+	if err != nil || len(data.Operations) == 0 {
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with a non-empty list of operations", nil).Send(conn)
+		return
+	}
+
+	// operations on the same key are chained, each one succeeding the previous
+	heads := make(map[string][]crdts.SignedOperation)
+	types := make(map[string]crdts.CRDT_TYPE)
+	entries := make([]storage.BatchEntry, 0, len(data.Operations))
+
+	for idx, batchOp := range data.Operations {
+		details := struct {
+			Index int `json:"index"`
+		}{Index: idx}
+
+		switch batchOp.Op {
+		case API_INC, API_DEC, API_ADD, API_RMV:
+		default:
+			logger.Alert("Operation", batchOp.Op, "is not allowed in a batch")
+			NewErrorMessage(ERR_UNSUPPORTED_OPERATION, fmt.Sprint("Operation ", batchOp.Op, " is not allowed in a batch"), details).Send(conn)
+			return
+		}
+
+		key := resolveKey(ctx, batchOp.Key)
+
+		if _, seen := heads[key]; !seen {
+			resultObject, err := ctx.Storage.Get(key)
+			if err != nil {
+				logger.Alert("Error getting item from key: ", err)
+				errorMessageFrom(err, details).Send(conn)
+				return
+			}
+			heads[key] = resultObject.Heads
+			types[key] = resultObject.Type
+		}
+
+		op, err := getOperation(batchOp.Op, types[key], ctx.Secretkey, batchOp.Value, heads[key])
+		if err != nil {
+			logger.Alert(err, batchOp.Value)
+			errorMessageFrom(err, details).Send(conn)
+			return
+		}
+
+		heads[key] = []crdts.SignedOperation{op}
+		entries = append(entries, storage.BatchEntry{Key: key, Op: op})
+	}
+
+	if err := ctx.Storage.AppendBatch(entries); err != nil {
+		logger.Error("Failed to apply batch due to:", err)
+		errorMessageFrom(err, nil).Send(conn)
+		return
+	}
+
+	NewMessage(OK).Send(conn)
+	broadcastBatch(ctx, entries)
+}
+
+func aliasMsg(ctx *context.AppContext, conn *Conn, body []byte) {
+	type aliasMsgBody struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
+
+	data, err := unmarshallJson[aliasMsgBody](body)
+	if err != nil || !crdts.IsValidAliasName(data.Name) {
+		NewErrorMessage(ERR_MALFORMED_REQUEST, "Expected a body with a valid alias name and a key", nil).Send(conn)
+		return
+	}
+
+	data.Key = resolveKey(ctx, data.Key)
+	if _, err := ctx.Storage.Get(data.Key); err != nil || data.Key == crdts.ALIAS_REGISTRY_KEY {
+		logger.Alert("Tried to alias an unknown key", data.Key)
+		NewErrorMessage(ERR_UNKNOWN_KEY, "Only existing keys can be aliased", nil).Send(conn)
+		return
+	}
+
+	registry := ctx.Storage.GetAliasRegistry()
+	publickey := hex.EncodeToString(ctx.Secretkey.Public().(ed25519.PublicKey))
+
+	owner, owned := registry.Owners[crdts.AliasNamespace(data.Name)]
+	if _, taken := registry.Aliases[data.Name]; taken || (owned && owner != publickey) {
+		logger.Alert("Alias", data.Name, "is already claimed")
+		NewErrorMessage(ERR_ALIAS_TAKEN, "The alias or its namespace is already claimed", struct {
+			Key   string `json:"key,omitempty"`
+			Owner string `json:"owner,omitempty"`
+		}{
+			Key:   registry.Aliases[data.Name],
+			Owner: owner,
+		}).Send(conn)
+		return
+	}
+
+	registryCell, _ := ctx.Storage.Get(crdts.ALIAS_REGISTRY_KEY)
+
+	op, err := crdts.ClaimAliasOp(ctx.Secretkey, data.Name, data.Key, registryCell.Heads)
+	if err == nil {
+		err = ctx.Storage.Append(crdts.ALIAS_REGISTRY_KEY, op)
+	}
+
+	if err != nil {
+		logger.Alert(err, data.Name)
+		errorMessageFrom(err, nil).Send(conn)
 	} else {
-		logger.Alert(err, data.Value)
-		NewMessage(NO).Send(conn)
+		NewMessage(OK).AddContent(struct {
+			Name string `json:"name"`
+			Key  string `json:"key"`
+		}{Name: data.Name, Key: data.Key}).Send(conn)
+		broadcast(ctx, crdts.ALIAS_REGISTRY_KEY, op)
+	}
+}
+
+// Keys that are not stored are looked up in the alias registry
+func resolveKey(ctx *context.AppContext, key string) string {
+	if _, err := ctx.Storage.Get(key); err == nil {
+		return key
+	}
+
+	if aliased, exists := ctx.Storage.GetAliasRegistry().Aliases[key]; exists {
+		return aliased
 	}
+
+	return key
 }
 
 func getOperation(opType MessageHeader, crdtType crdts.CRDT_TYPE, secretkey ed25519.PrivateKey, value interface{}, heads []crdts.SignedOperation) ([]byte, error) {
@@ -152,10 +482,10 @@ func getOperation(opType MessageHeader, crdtType crdts.CRDT_TYPE, secretkey ed25
 	}
 
 invalid:
-	return []byte{}, errors.New(fmt.Sprint("No operation of type ", opType, " exists for the CRDT ", crdtType))
+	return []byte{}, fmt.Errorf("%w: %s on %s", errUnsupportedOperation, opType, crdtType)
 
 wrongValueType:
-	return []byte{}, errors.New("Provided the wrong value type for the operation")
+	return []byte{}, errWrongValueType
 }
 
 func unmarshallJson[T interface{}](body []byte) (T, error) {
@@ -166,12 +496,3 @@ func unmarshallJson[T interface{}](body []byte) (T, error) {
 	}
 	return data, err
 }
-
-func storeOperation(ctx *context.AppContext, conn net.Conn, key string, op []byte) bool {
-	if err := ctx.Storage.Append(key, op); err != nil {
-		logger.Error("Failed to create operation on key", key, "due to:", err)
-		return false
-	} else {
-		return true
-	}
-}
@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"bftkvstore/context"
+	"bftkvstore/crdts"
+	"bftkvstore/storage"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Sends the request to the handler over an in-memory connection and returns
+// the reply
+func requestHandler(t *testing.T, handler func(conn *Conn, body []byte), body string) Message {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		handler(NewConn(server), []byte(body))
+	}()
+
+	payload, _, err := ReadFromConnection(NewConn(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := MessageFromPayload(payload)
+	if !ok {
+		t.Fatal("Malformed reply", string(payload))
+	}
+	return msg
+}
+
+func TestHistDiamond(t *testing.T) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	ctx := context.New(secretkey, "127.0.0.1", "8089")
+
+	// op0 <- op1, op2, op3 <- op4
+	op0, _, _ := crdts.NewCounterOp(secretkey)
+	op1, _ := crdts.IncCounterOp(secretkey, 1, []crdts.SignedOperation{op0})
+	op2, _ := crdts.DecCounterOp(secretkey, 2, []crdts.SignedOperation{op0})
+	op3, _ := crdts.IncCounterOp(secretkey, 3, []crdts.SignedOperation{op0})
+	op4, _ := crdts.IncCounterOp(secretkey, 4, []crdts.SignedOperation{op1, op2, op3})
+
+	key := crdts.HashOperation(op0)
+	if err := ctx.Storage.Assign(key, op0); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range [][]byte{op1, op2, op3, op4} {
+		if err := ctx.Storage.Append(key, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply := requestHandler(t, func(conn *Conn, body []byte) { histMsg(&ctx, conn, body) }, `{"key":"`+key+`"}`)
+	if reply.header != OK {
+		t.Fatal("Expected R_OK but got", string(reply.header), string(reply.content))
+	}
+
+	var history struct {
+		Total      int                `json:"total"`
+		Operations []histOperationDTO `json:"operations"`
+	}
+	if err := json.Unmarshal(reply.content, &history); err != nil {
+		t.Fatal(err)
+	}
+	if history.Total != 5 || len(history.Operations) != 5 {
+		t.Fatal("Expected the 5 operations of the key but got", history.Total)
+	}
+
+	seen := make(map[string]bool)
+	for _, op := range history.Operations {
+		for _, pred := range op.Preds {
+			if !seen[pred] {
+				t.Error("The operation", op.Hash, "comes before its predecessor", pred)
+			}
+		}
+		seen[op.Hash] = true
+	}
+	if history.Operations[0].Hash != key || history.Operations[4].Hash != crdts.HashOperation(op4) {
+		t.Error("Expected the history to start with the new operation and end with the merge")
+	}
+}
+
+type listReplyDTO struct {
+	Keys []listKeyDTO `json:"keys"`
+	Next string       `json:"next"`
+}
+
+func listKeys(t *testing.T, ctx *context.AppContext, body string) listReplyDTO {
+	reply := requestHandler(t, func(conn *Conn, body []byte) { listMsg(ctx, conn, body) }, body)
+	if reply.header != OK {
+		t.Fatal("Expected R_OK but got", string(reply.header), string(reply.content))
+	}
+	list, err := unmarshallJson[listReplyDTO](reply.content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestList(t *testing.T) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+	ctx := context.New(secretkey, "127.0.0.1", "8089")
+	publicKey, otherSecretkey, _ := ed25519.GenerateKey(rand.Reader)
+	creator := hex.EncodeToString(publicKey)
+
+	for _, sk := range []ed25519.PrivateKey{secretkey, secretkey, otherSecretkey, otherSecretkey} {
+		op, _, _ := crdts.NewCounterOp(sk)
+		if err := ctx.Storage.Assign(crdts.HashOperation(op), op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gset, _, _ := crdts.NewCRDT(crdts.CRDT_GSET, secretkey)
+	if err := ctx.Storage.Assign(crdts.HashOperation(gset), gset); err != nil {
+		t.Fatal(err)
+	}
+
+	all := ctx.Storage.List()
+	expected := func(keep func(info storage.KeyInfoDTO) bool) string {
+		keys := make([]string, 0)
+		for _, info := range all {
+			if keep(info) {
+				keys = append(keys, info.Key)
+			}
+		}
+		return fmt.Sprint(keys)
+	}
+	keysOf := func(list listReplyDTO) string {
+		keys := make([]string, 0)
+		for _, key := range list.Keys {
+			keys = append(keys, key.Key)
+		}
+		return fmt.Sprint(keys)
+	}
+
+	prefix := all[0].Key[:1]
+	tests := []struct {
+		name string
+		body string
+		keys string
+	}{
+		{"every key", `{}`, expected(func(info storage.KeyInfoDTO) bool { return true })},
+		{"by type", `{"type":"counter"}`, expected(func(info storage.KeyInfoDTO) bool { return info.Type == crdts.CRDT_COUNTER })},
+		{"by creator", `{"creator":"` + creator + `"}`, expected(func(info storage.KeyInfoDTO) bool { return info.Creator == creator })},
+		{"by prefix", `{"prefix":"` + prefix + `"}`, expected(func(info storage.KeyInfoDTO) bool { return strings.HasPrefix(info.Key, prefix) })},
+		{"after the cursor", `{"cursor":"` + all[2].Key + `"}`, expected(func(info storage.KeyInfoDTO) bool { return info.Key > all[2].Key })},
+		{"by type and creator", `{"type":"gset","creator":"` + creator + `"}`, "[]"},
+	}
+
+	for _, test := range tests {
+		if keys := keysOf(listKeys(t, &ctx, test.body)); keys != test.keys {
+			t.Error(test.name, "expected", test.keys, "but got", keys)
+		}
+	}
+
+	// pages follow each other without gaps nor repetitions
+	paged := make([]listKeyDTO, 0)
+	cursor := ""
+	for page := 0; page == 0 || cursor != ""; page++ {
+		list := listKeys(t, &ctx, `{"limit":2,"cursor":"`+cursor+`"}`)
+		if len(list.Keys) > 2 || page > len(all) {
+			t.Fatal("Expected pages of at most 2 keys but got", len(list.Keys), "on page", page)
+		}
+		paged = append(paged, list.Keys...)
+		cursor = list.Next
+	}
+	if keysOf(listReplyDTO{Keys: paged}) != tests[0].keys {
+		t.Error("Expected the pages to hold every key once but got", keysOf(listReplyDTO{Keys: paged}))
+	}
+	if !slices.IsSortedFunc(paged, func(a, b listKeyDTO) int { return strings.Compare(a.Key, b.Key) }) {
+		t.Error("Expected the keys ordered")
+	}
+
+	reply := requestHandler(t, func(conn *Conn, body []byte) { listMsg(&ctx, conn, body) }, `{"limit":-1}`)
+	if reply.header != ERR {
+		t.Error("Expected a negative limit to be malformed but got", string(reply.header))
+	}
+}
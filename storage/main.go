@@ -2,14 +2,29 @@ package storage
 
 import (
 	"bftkvstore/crdts"
+	"bftkvstore/set"
+	"bftkvstore/utils"
 	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"sync"
 )
 
+var (
+	ErrKeyNotFound      = errors.New("Storage cell does not exist")
+	ErrKeyExists        = errors.New("Tried to assign an already used key value")
+	ErrInvalidOperation = errors.New("Failed to parse the given operation bytes")
+	ErrTypeMismatch     = errors.New("The given operation is not of the same type as the key storing")
+	ErrUnknownPreds     = errors.New("Attempted to append operation with unknown predecessors")
+	ErrUnknownOperation = errors.New("Operation does not exist in the key")
+	ErrHeadsChanged     = errors.New("The heads of the key are not the expected ones")
+)
+
 type Storage struct {
-	lock sync.RWMutex
-	data map[string]StorageCell // TODO: This needs to be stored in memory
+	lock  sync.RWMutex
+	data  map[string]StorageCell // TODO: This needs to be stored in memory
+	index map[string]string      // operation hash -> key
 }
 
 type StorageCell struct {
@@ -20,8 +35,16 @@ type StorageCell struct {
 }
 
 func Init() Storage {
+	aliasRegistry := StorageCell{
+		operations: make([]crdts.SignedOperation, 0),
+		crdtType:   crdts.CRDT_ALIAS,
+		heads:      make([]crdts.SignedOperation, 0),
+	}
+	aliasRegistry.update()
+
 	return Storage{
-		data: make(map[string]StorageCell),
+		data:  map[string]StorageCell{crdts.ALIAS_REGISTRY_KEY: aliasRegistry},
+		index: make(map[string]string),
 	}
 }
 
@@ -31,12 +54,12 @@ func (st *Storage) Assign(key string, value crdts.SignedOperation) error {
 
 	_, exists := st.data[key]
 	if exists {
-		return errors.New("Tried to assign an already used key value")
+		return ErrKeyExists
 	}
 
 	valueOpParsed, err := crdts.ReadOperation(value)
 	if err != nil {
-		return errors.New("Failed to parse the given operation bytes")
+		return ErrInvalidOperation
 	}
 
 	newCell := StorageCell{operations: make([]crdts.SignedOperation, 1), crdtType: valueOpParsed.Type, heads: make([]crdts.SignedOperation, 1)}
@@ -46,6 +69,7 @@ func (st *Storage) Assign(key string, value crdts.SignedOperation) error {
 	newCell.update()
 
 	st.data[key] = newCell
+	st.index[crdts.HashOperation(value)] = key
 
 	return nil
 }
@@ -63,46 +87,191 @@ func (st *Storage) Get(key string) (val GetResultDTO, err error) {
 	cell, exists := st.data[key]
 
 	if !exists {
-		return val, errors.New(fmt.Sprint("Storage cell with key ", key, " does not exist"))
+		return val, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
 	}
 
 	return GetResultDTO{Value: cell.value, Type: cell.crdtType, Heads: cell.heads}, nil
 }
 
+// Computes the value of a key considering only the causal past of the
+// operations in the frontier (the frontier operations included)
+func (st *Storage) GetAt(key string, frontier []string) (val GetResultDTO, err error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	cell, exists := st.data[key]
+
+	if !exists {
+		return val, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	opsByHash := make(map[string]crdts.SignedOperation)
+	for _, op := range cell.operations {
+		opsByHash[crdts.HashOperation(op)] = op
+	}
+
+	for _, hash := range frontier {
+		if _, exists := opsByHash[hash]; !exists {
+			return val, fmt.Errorf("%w: %s", ErrUnknownOperation, hash)
+		}
+	}
+
+	visited := make(map[string]bool)
+	queue := append([]string{}, frontier...)
+	pastOps := make([]crdts.SignedOperation, 0)
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		if visited[hash] {
+			continue
+		}
+		visited[hash] = true
+
+		signedOp := opsByHash[hash]
+		pastOps = append(pastOps, signedOp)
+
+		op, err := crdts.ReadOperation(signedOp)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, op.Preds...)
+	}
+
+	result := crdts.CalculateOperations(pastOps, cell.crdtType)
+
+	return GetResultDTO{Value: result.Value, Type: cell.crdtType, Heads: result.Heads}, nil
+}
+
+// Finds the key that stores the operation with the given hash
+func (st *Storage) KeyOf(opHash string) (key string, exists bool) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	key, exists = st.index[opHash]
+	return
+}
+
+func (st *Storage) GetOperations(key string) ([]crdts.SignedOperation, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	cell, exists := st.data[key]
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	operations := make([]crdts.SignedOperation, len(cell.operations))
+	copy(operations, cell.operations)
+
+	return operations, nil
+}
+
 func (st *Storage) Append(key string, newOp crdts.SignedOperation) error {
+	return st.appendIf(key, newOp, false)
+}
+
+// Appends the operation only if its predecessors are exactly the current
+// heads of the key, failing with ErrHeadsChanged otherwise
+func (st *Storage) AppendOnHeads(key string, newOp crdts.SignedOperation) error {
+	return st.appendIf(key, newOp, true)
+}
+
+func (st *Storage) appendIf(key string, newOp crdts.SignedOperation, onHeads bool) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 
 	cell, exists := st.data[key]
 	if !exists {
-		return errors.New("Tried to append to a non-existent key")
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
 	}
 
+	if onHeads {
+		newOpParsed, err := crdts.ReadOperation(newOp)
+		if err != nil {
+			return ErrInvalidOperation
+		}
+
+		if !slices.Equal(set.FromSlice(newOpParsed.Preds), set.FromSlice(utils.Map(cell.heads, crdts.HashOperation))) {
+			return ErrHeadsChanged
+		}
+	}
+
+	if err := cell.append(newOp); err != nil {
+		return err
+	}
+	cell.update()
+
+	st.data[key] = cell
+	st.index[crdts.HashOperation(newOp)] = key
+
+	return nil
+}
+
+type BatchEntry struct {
+	Key string
+	Op  crdts.SignedOperation
+}
+
+// Appends every operation of the batch, in order, or none of them
+func (st *Storage) AppendBatch(entries []BatchEntry) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	cells := make(map[string]StorageCell)
+	for _, entry := range entries {
+		cell, exists := cells[entry.Key]
+		if !exists {
+			cell, exists = st.data[entry.Key]
+			if !exists {
+				return fmt.Errorf("%w: %s", ErrKeyNotFound, entry.Key)
+			}
+			cell.operations = slices.Clone(cell.operations)
+		}
+
+		if err := cell.append(entry.Op); err != nil {
+			return fmt.Errorf("Failed to append to key %s: %w", entry.Key, err)
+		}
+
+		cells[entry.Key] = cell
+	}
+
+	for key, cell := range cells {
+		cell.update()
+		st.data[key] = cell
+	}
+	for _, entry := range entries {
+		st.index[crdts.HashOperation(entry.Op)] = entry.Key
+	}
+
+	return nil
+}
+
+func (c *StorageCell) append(newOp crdts.SignedOperation) error {
 	valueOpParsed, err := crdts.ReadOperation(newOp)
 	if err != nil {
-		return errors.New("Failed to parse the given operation bytes")
+		return ErrInvalidOperation
 	}
 
-	if valueOpParsed.Type != cell.crdtType {
-		return errors.New("The given operation is not of the same type as the key storing")
+	if valueOpParsed.Type != c.crdtType {
+		return ErrTypeMismatch
 	}
 
 	for _, pred := range valueOpParsed.Preds {
 		found := false
-		for _, op := range cell.operations {
+		for _, op := range c.operations {
 			if pred == crdts.HashOperation(op) {
 				found = true
 			}
 		}
 		if !found {
-			return errors.New("Attempted to append operation with unknown predecessors")
+			return ErrUnknownPreds
 		}
 	}
 
-	cell.operations = append(cell.operations, newOp)
-	cell.update()
-
-	st.data[key] = cell
+	c.operations = append(c.operations, newOp)
 
 	return nil
 }
@@ -114,9 +283,53 @@ func (c *StorageCell) update() {
 	c.value = result.Value
 }
 
+type KeyInfoDTO struct {
+	Key        string
+	Type       crdts.CRDT_TYPE
+	Operations int
+	Creator    string
+}
+
+// Lists the stored keys ordered by key
+func (st *Storage) List() []KeyInfoDTO {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	keys := make([]KeyInfoDTO, 0, len(st.data))
+	for k, v := range st.data {
+		creator := ""
+		if len(v.operations) > 0 {
+			creator = crdts.OperationAuthor(v.operations[0])
+		}
+
+		keys = append(keys, KeyInfoDTO{
+			Key:        k,
+			Type:       v.crdtType,
+			Operations: len(v.operations),
+			Creator:    creator,
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key < keys[j].Key
+	})
+
+	return keys
+}
+
+func (st *Storage) GetAliasRegistry() crdts.AliasRegistry {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	return st.data[crdts.ALIAS_REGISTRY_KEY].value.(crdts.AliasRegistry)
+}
+
 func (st *Storage) GetHeads() map[string][]crdts.SignedOperation {
 	// This is obviously inefficient in the long run
 	// but we roll with it for now
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
 	heads := make(map[string][]crdts.SignedOperation)
 	for k, v := range st.data {
 		heads[k] = v.heads
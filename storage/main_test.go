@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bftkvstore/crdts"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Creates a counter incremented twice, one increment after the other
+func newTestCounter(t *testing.T, st *Storage) (key string, ops []crdts.SignedOperation) {
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+
+	op0, _, err := crdts.NewCounterOp(secretkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op1, err := crdts.IncCounterOp(secretkey, 1, []crdts.SignedOperation{op0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op2, err := crdts.IncCounterOp(secretkey, 2, []crdts.SignedOperation{op1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key = crdts.HashOperation(op0)
+	if err := st.Assign(key, op0); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []crdts.SignedOperation{op1, op2} {
+		if err := st.Append(key, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key, []crdts.SignedOperation{op0, op1, op2}
+}
+
+func TestGetAt(t *testing.T) {
+	st := Init()
+	key, ops := newTestCounter(t, &st)
+	_, otherOps := newTestCounter(t, &st)
+
+	tests := []struct {
+		name     string
+		frontier []string
+		value    string
+		err      error
+	}{
+		{"latest", []string{crdts.HashOperation(ops[2])}, "3", nil},
+		{"past", []string{crdts.HashOperation(ops[1])}, "1", nil},
+		{"creation", []string{key}, "0", nil},
+		{"unknown frontier", []string{"00"}, "", ErrUnknownOperation},
+		{"operation of another key", []string{crdts.HashOperation(otherOps[1])}, "", ErrUnknownOperation},
+		{"partly unknown frontier", []string{crdts.HashOperation(ops[1]), "00"}, "", ErrUnknownOperation},
+	}
+
+	for _, test := range tests {
+		result, err := st.GetAt(key, test.frontier)
+		if !errors.Is(err, test.err) {
+			t.Error(test.name, "expected the error", test.err, "but got", err)
+			continue
+		}
+		if err == nil && fmt.Sprint(result.Value) != test.value {
+			t.Error(test.name, "expected the value", test.value, "but got", result.Value)
+		}
+	}
+
+	if _, err := st.GetAt("unknown", []string{key}); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected an unknown key to fail but got", err)
+	}
+}
+
+func TestAppendBatch(t *testing.T) {
+	st := Init()
+	key, ops := newTestCounter(t, &st)
+	otherKey, otherOps := newTestCounter(t, &st)
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+
+	inc, _ := crdts.IncCounterOp(secretkey, 4, ops[2:])
+	otherInc, _ := crdts.IncCounterOp(secretkey, 8, otherOps[2:])
+	afterInc, _ := crdts.IncCounterOp(secretkey, 16, []crdts.SignedOperation{inc})
+	unknownPreds, _ := crdts.IncCounterOp(secretkey, 32, []crdts.SignedOperation{otherInc})
+	otherType, _ := crdts.AddGSetOp(secretkey, "a", ops[2:])
+
+	tests := []struct {
+		name    string
+		entries []BatchEntry
+		err     error
+	}{
+		{"unknown key", []BatchEntry{{key, inc}, {"unknown", otherInc}}, ErrKeyNotFound},
+		{"unknown preds", []BatchEntry{{key, inc}, {otherKey, otherInc}, {key, unknownPreds}}, ErrUnknownPreds},
+		{"wrong type", []BatchEntry{{otherKey, otherInc}, {key, otherType}}, ErrTypeMismatch},
+		{"invalid operation", []BatchEntry{{key, inc}, {otherKey, otherInc[:len(otherInc)-1]}}, ErrInvalidOperation},
+	}
+
+	// none of the failing batches leaves a trace
+	for _, test := range tests {
+		if err := st.AppendBatch(test.entries); !errors.Is(err, test.err) {
+			t.Error(test.name, "expected the error", test.err, "but got", err)
+		}
+		for _, checked := range []struct {
+			key string
+			ops int
+		}{{key, 3}, {otherKey, 3}} {
+			if stored, _ := st.GetOperations(checked.key); len(stored) != checked.ops {
+				t.Error(test.name, "expected the batch to append nothing but", checked.key, "has", len(stored), "operations")
+			}
+		}
+		if _, indexed := st.KeyOf(crdts.HashOperation(inc)); indexed {
+			t.Error(test.name, "expected the operations of the batch to not be indexed")
+		}
+	}
+
+	// operations may depend on earlier ones of the batch
+	if err := st.AppendBatch([]BatchEntry{{key, inc}, {otherKey, otherInc}, {key, afterInc}}); err != nil {
+		t.Fatal("Expected the batch to be appended but got", err)
+	}
+	for _, checked := range []struct {
+		key   string
+		value string
+	}{{key, "23"}, {otherKey, "11"}} {
+		if result, _ := st.Get(checked.key); fmt.Sprint(result.Value) != checked.value {
+			t.Error("Expected", checked.key, "to be", checked.value, "but got", result.Value)
+		}
+	}
+	if found, _ := st.KeyOf(crdts.HashOperation(afterInc)); found != key {
+		t.Error("Expected the operations of the batch to be indexed")
+	}
+}
+
+func TestAppendOnHeads(t *testing.T) {
+	st := Init()
+	key, ops := newTestCounter(t, &st)
+	_, secretkey, _ := ed25519.GenerateKey(rand.Reader)
+
+	stale, _ := crdts.IncCounterOp(secretkey, 4, ops[1:2])
+	onHeads, _ := crdts.IncCounterOp(secretkey, 8, ops[2:])
+	onOldHeads, _ := crdts.IncCounterOp(secretkey, 16, ops[2:])
+
+	if err := st.AppendOnHeads(key, stale); !errors.Is(err, ErrHeadsChanged) {
+		t.Error("Expected an operation on stale heads to fail but got", err)
+	}
+	if err := st.AppendOnHeads(key, onHeads); err != nil {
+		t.Fatal("Expected an operation on the heads to be appended but got", err)
+	}
+	// the heads moved with the last append
+	if err := st.AppendOnHeads(key, onOldHeads); !errors.Is(err, ErrHeadsChanged) {
+		t.Error("Expected an operation on the previous heads to fail but got", err)
+	}
+	if err := st.AppendOnHeads("unknown", onHeads); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("Expected an unknown key to fail but got", err)
+	}
+
+	result, _ := st.Get(key)
+	if fmt.Sprint(result.Value) != "11" || len(result.Heads) != 1 || crdts.HashOperation(result.Heads[0]) != crdts.HashOperation(onHeads) {
+		t.Error("Expected only the operation on the heads to be appended but got", result.Value)
+	}
+
+	// a plain append does not check the heads
+	if err := st.Append(key, stale); err != nil {
+		t.Error("Expected the concurrent operation to be appended but got", err)
+	}
+}
@@ -1,19 +1,46 @@
 package utils
 
 import (
-	"bftkvstore/logger"
 	"net"
+	"slices"
 )
 
-// Get preferred outbound ip of this machine
-func GetOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		logger.Fatal(err)
+// Lists the addresses of the interfaces that are up, IPv4 first, without
+// loopback and link-local addresses. Falls back to the IPv4 loopback when the
+// machine has no other address.
+func InterfaceIPs() []net.IP {
+	ips := make([]net.IP, 0)
+
+	interfaces, err := net.Interfaces()
+	if err == nil {
+		for _, iface := range interfaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+					ips = append(ips, ipNet.IP)
+				}
+			}
+		}
 	}
-	defer conn.Close()
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	if len(ips) == 0 {
+		return []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
 
-	return localAddr.IP
+	slices.SortStableFunc(ips, func(a net.IP, b net.IP) int {
+		family := func(ip net.IP) int {
+			if ip.To4() != nil {
+				return 4
+			}
+			return 6
+		}
+		return family(a) - family(b)
+	})
+	return ips
 }